@@ -3,9 +3,12 @@ package bitly
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+
+	"github.com/threecommaio/opc/core/requestid"
 )
 
 const apiURL = "https://api-ssl.bitly.com/v4"
@@ -34,15 +37,19 @@ type ShortenResponse struct {
 }
 
 func New(token string) *Bitly {
-	client := &http.Client{}
 	return &Bitly{
 		token:  token,
-		client: client,
+		client: requestid.Client,
 	}
 }
 
 // Shorten takes a long URL and returns a short URL
 func (b *Bitly) Shorten(link string) (string, error) {
+	return b.ShortenContext(context.Background(), link)
+}
+
+// ShortenContext is Shorten with a context, the request id it carries is sent to bitly
+func (b *Bitly) ShortenContext(ctx context.Context, link string) (string, error) {
 	var sres ShortenResponse
 	jsonBody, err := json.Marshal(ShortenRequest{
 		LongURL: link,
@@ -50,7 +57,7 @@ func (b *Bitly) Shorten(link string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	req, err := http.NewRequest("POST", apiURL+"/shorten", bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", apiURL+"/shorten", bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return "", err
 	}
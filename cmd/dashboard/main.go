@@ -0,0 +1,138 @@
+// Command dashboard generates a grafana dashboard from the metrics a service
+// registers and exposes and writes it as JSON or pushes it to grafana
+//
+//	dashboard --metrics-url http://localhost:8080/metrics -o dashboard.json
+//	dashboard --metrics-url http://localhost:8080/metrics --grafana-url https://grafana.example.com
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	arg "github.com/alexflint/go-arg"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/threecommaio/opc/metric"
+)
+
+type args struct {
+	MetricsURL     string   `arg:"--metrics-url,required" help:"metrics endpoint of a running service"`
+	DefinitionsURL string   `arg:"--definitions-url" help:"metric definitions served by metric.Registry, defaults to the metrics url + /definitions"`
+	Title          string   `help:"dashboard title, defaults to the project"`
+	Namespace      string   `help:"metric namespace stripped to find subsystems"`
+	Datasource     string   `help:"grafana prometheus datasource" default:"Prometheus"`
+	Tags           []string `help:"dashboard tags"`
+	Output         string   `arg:"-o" help:"file to write the JSON to, - for stdout" default:"-"`
+	GrafanaURL     string   `arg:"--grafana-url,env:GRAFANA_URL" help:"push to this grafana instead of writing JSON"`
+	GrafanaToken   string   `arg:"--grafana-token,env:GRAFANA_TOKEN" help:"grafana api token"`
+	Folder         string   `help:"grafana folder, defaults to the project"`
+}
+
+func main() {
+	var a args
+	arg.MustParse(&a)
+
+	if err := run(a); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(a args) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	definitionsURL := a.DefinitionsURL
+	if definitionsURL == "" {
+		definitionsURL = strings.TrimSuffix(a.MetricsURL, "/") + metric.DefinitionsSuffix
+	}
+	// the registry knows metrics that haven't been observed yet, the scrape
+	// adds the ones registered elsewhere
+	registered, err := fetchDefinitions(ctx, definitionsURL)
+	if err != nil {
+		log.Warnf("scraping metrics only: %s", err)
+	}
+	scraped, err := scrapeDefinitions(ctx, a.MetricsURL)
+	if err != nil {
+		return err
+	}
+	defs := metric.MergeDefinitions(registered, scraped)
+
+	builder, err := metric.NewDashboard(metric.DashboardConfig{
+		Title:      a.Title,
+		Namespace:  a.Namespace,
+		Datasource: a.Datasource,
+		Tags:       a.Tags,
+	}, defs)
+	if err != nil {
+		return err
+	}
+
+	if a.GrafanaURL != "" {
+		return metric.PushDashboard(ctx, metric.GrafanaConfig{
+			URL:    a.GrafanaURL,
+			Token:  a.GrafanaToken,
+			Folder: a.Folder,
+		}, builder)
+	}
+
+	if a.Output == "-" {
+		return metric.WriteDashboard(os.Stdout, builder)
+	}
+	f, err := os.Create(a.Output)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", a.Output, err)
+	}
+	defer f.Close()
+
+	return metric.WriteDashboard(f, builder)
+}
+
+// fetchDefinitions reads the definitions served by metric.Registry.DefinitionsHandler
+func fetchDefinitions(ctx context.Context, url string) ([]metric.Definition, error) {
+	resp, err := get(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch metric definitions: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var defs []metric.Definition
+	if err := json.NewDecoder(resp.Body).Decode(&defs); err != nil {
+		return nil, fmt.Errorf("failed to decode metric definitions: %w", err)
+	}
+
+	return defs, nil
+}
+
+// scrapeDefinitions describes the metrics exposed at url
+func scrapeDefinitions(ctx context.Context, url string) ([]metric.Definition, error) {
+	resp, err := get(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrape metrics: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return metric.Definitions(metric.TextGatherer(resp.Body))
+}
+
+// get requests url and checks for a 200
+func get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	return resp, nil
+}
@@ -3,7 +3,10 @@ package hmac
 
 import (
 	"crypto/hmac"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -18,54 +21,246 @@ var (
 	errSigParse          = errors.New("signature parsing failed")
 	errSigVer            = errors.New("signature version invalid")
 	errSigDecode         = errors.New("signature decoding failed")
+	errAlgorithm         = errors.New("unsupported algorithm")
+	errEncoding          = errors.New("unsupported encoding")
+	errNoKeys            = errors.New("no secret keys provided")
 )
 
-// ValidateSignature validates the signature for the given message based on
-// the allowed version such as sha1 or v1 depending on how provider chose.
-func ValidateSignature(allowedVersion string, signature string, payload, secretToken []byte) error {
-	messageMAC, hashFunc, err := messageMAC(allowedVersion, signature)
+// Key is a candidate secret, the ID reports which key matched while rotating.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Algorithm is the hash function used to compute the hmac.
+type Algorithm string
+
+// supported algorithms
+const (
+	SHA1   Algorithm = "sha1"
+	SHA256 Algorithm = "sha256"
+	SHA512 Algorithm = "sha512"
+)
+
+// Encoding is how the hmac tag is encoded in the signature.
+type Encoding int
+
+// supported encodings
+const (
+	Hex Encoding = iota
+	Base64
+	Base64URL
+)
+
+// Scheme describes how a provider signs a message: the hash, how the tag is
+// encoded, its prefix and which message is signed.
+type Scheme struct {
+	Algorithm Algorithm
+	Encoding  Encoding
+	// Prefix precedes the encoded tag such as "sha256=" or "v0=".
+	Prefix string
+	// BaseString composes the signed message from the payload and extra parts
+	// such as a timestamp, nil signs the payload as is.
+	BaseString func(payload []byte, parts ...string) []byte
+}
+
+// well known schemes
+var (
+	Github  = Scheme{Algorithm: SHA256, Encoding: Hex, Prefix: "sha256="}
+	Linear  = Scheme{Algorithm: SHA256, Encoding: Hex}
+	Shopify = Scheme{Algorithm: SHA256, Encoding: Base64}
+	Twilio  = Scheme{Algorithm: SHA1, Encoding: Base64}
+	// Slack signs "v0:timestamp:body", pass "v0" and the timestamp as parts.
+	Slack = Scheme{Algorithm: SHA256, Encoding: Hex, Prefix: "v0=", BaseString: JoinBaseString(":")}
+	// Stripe signs "timestamp.body", pass the timestamp as part.
+	Stripe = Scheme{Algorithm: SHA256, Encoding: Hex, Prefix: "v1=", BaseString: JoinBaseString(".")}
+	// Webhook signs "timestamp.body" like Stripe with a github style prefix,
+	// it is what package webhook sends.
+	Webhook = Scheme{Algorithm: SHA256, Encoding: Hex, Prefix: "sha256=", BaseString: JoinBaseString(".")}
+)
+
+// JoinBaseString returns a BaseString that joins the parts followed by the
+// payload with sep.
+func JoinBaseString(sep string) func(payload []byte, parts ...string) []byte {
+	return func(payload []byte, parts ...string) []byte {
+		if len(parts) == 0 {
+			return payload
+		}
+		prefix := strings.Join(parts, sep) + sep
+
+		return append([]byte(prefix), payload...)
+	}
+}
+
+// Sign returns the signature for the payload using the scheme, so outbound
+// messages are produced with the same code that verifies them.
+func Sign(scheme Scheme, payload, secretToken []byte, parts ...string) (string, error) {
+	hashFunc, err := scheme.Algorithm.hash()
+	if err != nil {
+		return "", err
+	}
+	tag, err := scheme.Encoding.encode(genMAC(scheme.message(payload, parts), secretToken, hashFunc))
+	if err != nil {
+		return "", err
+	}
+
+	return scheme.Prefix + tag, nil
+}
+
+// Validate validates the signature for the payload using the scheme.
+func (s Scheme) Validate(signature string, payload, secretToken []byte, parts ...string) error {
+	if signature == "" {
+		return errSigMissing
+	}
+	hashFunc, err := s.Algorithm.hash()
 	if err != nil {
 		return err
 	}
-	if !checkMAC(payload, messageMAC, secretToken, hashFunc) {
+	if !strings.HasPrefix(signature, s.Prefix) {
+		return fmt.Errorf("%w: %q", errSigVer, signature)
+	}
+	buf, err := s.Encoding.decode(strings.TrimPrefix(signature, s.Prefix))
+	if err != nil {
+		return fmt.Errorf("%w %q: %v", errSigDecode, signature, err)
+	}
+	if !checkMAC(s.message(payload, parts), buf, secretToken, hashFunc) {
 		return errSigCheck
 	}
 
 	return nil
 }
 
-// messageMAC returns the hex-decoded HMAC tag from the signature and its
-// corresponding hash function.
-func messageMAC(allowedVersion string, signature string) ([]byte, func() hash.Hash, error) {
+// ValidateKeys validates the signature against every key and returns the one
+// that matched, see ValidateSignatureKeys.
+func (s Scheme) ValidateKeys(signature string, payload []byte, keys []Key, parts ...string) (Key, error) {
+	return MatchKey(keys, func(secret []byte) error {
+		return s.Validate(signature, payload, secret, parts...)
+	})
+}
+
+// message returns the signed message for the payload.
+func (s Scheme) message(payload []byte, parts []string) []byte {
+	if s.BaseString == nil {
+		return payload
+	}
+
+	return s.BaseString(payload, parts...)
+}
+
+// hash returns the hash function for the algorithm.
+func (a Algorithm) hash() (func() hash.Hash, error) {
+	switch a {
+	case SHA1:
+		return sha1.New, nil
+	case SHA256:
+		return sha256.New, nil
+	case SHA512:
+		return sha512.New, nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", errAlgorithm, a)
+}
+
+func (e Encoding) encode(buf []byte) (string, error) {
+	switch e {
+	case Hex:
+		return hex.EncodeToString(buf), nil
+	case Base64:
+		return base64.StdEncoding.EncodeToString(buf), nil
+	case Base64URL:
+		return base64.URLEncoding.EncodeToString(buf), nil
+	}
+
+	return "", fmt.Errorf("%w: %d", errEncoding, e)
+}
+
+func (e Encoding) decode(s string) ([]byte, error) {
+	switch e {
+	case Hex:
+		return hex.DecodeString(s)
+	case Base64:
+		return base64.StdEncoding.DecodeString(s)
+	case Base64URL:
+		// senders disagree on padding for base64url
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+
+	return nil, fmt.Errorf("%w: %d", errEncoding, e)
+}
+
+// ValidateSignature validates the signature for the given message based on
+// the allowed version such as sha1 or v1 depending on how provider chose. The
+// tag is hex encoded, use a Scheme for other encodings.
+func ValidateSignature(allowedVersion string, signature string, payload, secretToken []byte) error {
+	scheme, err := versionScheme(allowedVersion, signature)
+	if err != nil {
+		return err
+	}
+
+	return scheme.Validate(signature, payload, secretToken)
+}
+
+// ValidateSignatureKeys validates the signature against each candidate key and
+// returns the key that matched. Every key is checked so the time taken does not
+// reveal which one matched.
+func ValidateSignatureKeys(allowedVersion string, signature string, payload []byte, keys []Key) (Key, error) {
+	return MatchKey(keys, func(secret []byte) error {
+		return ValidateSignature(allowedVersion, signature, payload, secret)
+	})
+}
+
+// MatchKey runs validate for every key without stopping at the first match
+// and returns the key that matched, for validators outside this package.
+func MatchKey(keys []Key, validate func(secret []byte) error) (Key, error) {
+	if len(keys) == 0 {
+		return Key{}, errNoKeys
+	}
+	var matched *Key
+	var err error
+	for i := range keys {
+		if keyErr := validate(keys[i].Secret); keyErr != nil {
+			err = keyErr
+		} else if matched == nil {
+			matched = &keys[i]
+		}
+	}
+	if matched == nil {
+		return Key{}, err
+	}
+
+	return *matched, nil
+}
+
+// ValidateHexSignature validates a bare hex encoded sha256 signature that
+// carries no version prefix, as sent by providers such as Linear.
+func ValidateHexSignature(signature string, payload, secretToken []byte) error {
+	return Linear.Validate(signature, payload, secretToken)
+}
+
+// versionScheme returns the hex scheme for a `version=<tag>` signature, the
+// version names the algorithm and anything else such as v1 is sha256.
+func versionScheme(allowedVersion string, signature string) (Scheme, error) {
 	if signature == "" {
-		return nil, nil, errSigMissing
+		return Scheme{}, errSigMissing
 	}
 	if allowedVersion == "" {
-		return nil, nil, errAllowedVerMissing
+		return Scheme{}, errAllowedVerMissing
 	}
 	sigParts := strings.SplitN(signature, "=", 2)
 	if len(sigParts) != 2 {
-		return nil, nil, fmt.Errorf("%w: %q", errSigParse, signature)
+		return Scheme{}, fmt.Errorf("%w: %q", errSigParse, signature)
 	}
-
 	if sigParts[0] != allowedVersion {
-		return nil, nil, fmt.Errorf("%w: %q", errSigVer, sigParts[0])
-	}
-
-	var hashFunc func() hash.Hash
-	switch sigParts[0] {
-	case "v1":
-		fallthrough
-	default:
-		hashFunc = sha256.New
+		return Scheme{}, fmt.Errorf("%w: %q", errSigVer, sigParts[0])
 	}
 
-	buf, err := hex.DecodeString(sigParts[1])
-	if err != nil {
-		return nil, nil, fmt.Errorf("%w %q: %v", errSigDecode, signature, err)
+	algorithm := SHA256
+	switch Algorithm(sigParts[0]) {
+	case SHA1, SHA512:
+		algorithm = Algorithm(sigParts[0])
 	}
 
-	return buf, hashFunc, nil
+	return Scheme{Algorithm: algorithm, Encoding: Hex, Prefix: allowedVersion + "="}, nil
 }
 
 // genMAC generates the HMAC signature for a message provided the secret key
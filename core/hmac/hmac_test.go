@@ -0,0 +1,142 @@
+package hmac
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	slackSecret    = "8f742231b10e8888abcd99yyyzzz85a5"
+	slackTimestamp = "1531420618"
+	slackBody      = "token=xyzz0WbapA4vBCDEFasx0q6G&team_id=T1DC2JH3J&team_domain=testteamnow&" +
+		"channel_id=G8PSS9T3V&channel_name=foobar&user_id=U2CERLKJA&user_name=roadrunner&" +
+		"command=%2Fwebhook-collect&text=&response_url=https%3A%2F%2Fhooks.slack.com%2Fcommands%2F" +
+		"T1DC2JH3J%2F397700885554%2F96rGlfmibIGlgcZRskXaIFfN&" +
+		"trigger_id=398738663015.47445629121.803a0bc887a14d10d2c447fce8b6703c"
+	slackSignature = "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503"
+
+	sha1Hex      = "5112055c05f944f85755efc5cd8970e194e9f45b"
+	sha512Hex    = "db1595ae88a62fd151ec1cba81b98c39df82daae7b4cb9820f446d5bf02f1dcfca6683d88cab3e273f5963ab8ec469a746b5b19086371239f67d1e5f99a79440"
+	sha256Hex    = "88aab3ede8d3adf94d26ab90d3bafd4a2083070c3bcce9c014ee04a443847c0b"
+	sha1B64URL   = "URIFXAX5RPhXVe_FzYlw4ZTp9Fs="
+	sha512B64URL = "2xWVroimL9FR7By6gbmMOd-C2q57TLmCD0RtW_AvHc_KZoPYjKs-Jz9ZY6uOxGmnRrWxkIY3Ejn2fR5fmaeUQA=="
+)
+
+func TestValidateSignature(t *testing.T) {
+	tests := []struct {
+		name      string
+		version   string
+		signature string
+		wantErr   bool
+	}{
+		{"sha1 hex", "sha1", "sha1=" + sha1Hex, false},
+		{"sha512 hex", "sha512", "sha512=" + sha512Hex, false},
+		{"v1 is sha256", "v1", "v1=" + sha256Hex, false},
+		{"base64url needs a scheme", "sha1", "sha1=" + sha1B64URL, true},
+		{"wrong version", "sha256", "sha1=" + sha1Hex, true},
+		{"wrong algorithm", "sha512", "sha512=" + sha1Hex, true},
+		{"missing", "sha1", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateSignature(tt.version, tt.signature, []byte("hello"), []byte("secret"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestSchemeEncoding(t *testing.T) {
+	sha1URL := Scheme{Algorithm: SHA1, Encoding: Base64URL, Prefix: "sha1="}
+	sha512URL := Scheme{Algorithm: SHA512, Encoding: Base64URL, Prefix: "sha512="}
+	sha1Base64 := Scheme{Algorithm: SHA1, Encoding: Base64, Prefix: "sha1="}
+	tests := []struct {
+		name      string
+		scheme    Scheme
+		signature string
+		wantErr   bool
+	}{
+		{"sha1 base64url", sha1URL, "sha1=" + sha1B64URL, false},
+		{"sha512 base64url", sha512URL, "sha512=" + sha512B64URL, false},
+		{"sha1 base64url unpadded", sha1URL, "sha1=" + strings.TrimRight(sha1B64URL, "="), false},
+		// hex is valid base64 too, the declared encoding decides
+		{"hex for base64", sha1Base64, "sha1=" + sha1Hex, true},
+		{"base64url for hex", Scheme{Algorithm: SHA1, Encoding: Hex, Prefix: "sha1="}, "sha1=" + sha1B64URL, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.scheme.Validate(tt.signature, []byte("hello"), []byte("secret"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestSchemeSlackBaseString(t *testing.T) {
+	if err := Slack.Validate(slackSignature, []byte(slackBody), []byte(slackSecret), "v0", slackTimestamp); err != nil {
+		t.Fatalf("Failed to validate slack signature: %s", err)
+	}
+	if err := Slack.Validate(slackSignature, []byte(slackBody), []byte(slackSecret), "v0", "1531420619"); err == nil {
+		t.Fatalf("Expected a different timestamp to fail")
+	}
+
+	signature, err := Sign(Slack, []byte(slackBody), []byte(slackSecret), "v0", slackTimestamp)
+	if err != nil {
+		t.Fatalf("Failed to sign: %s", err)
+	}
+	if signature != slackSignature {
+		t.Fatalf("Unexpected signature: got %s, want %s", signature, slackSignature)
+	}
+}
+
+func TestSignRoundTrip(t *testing.T) {
+	schemes := map[string]Scheme{
+		"github":    Github,
+		"linear":    Linear,
+		"shopify":   Shopify,
+		"twilio":    Twilio,
+		"stripe":    Stripe,
+		"sha512url": {Algorithm: SHA512, Encoding: Base64URL, Prefix: "sha512="},
+	}
+	for name, scheme := range schemes {
+		t.Run(name, func(t *testing.T) {
+			signature, err := Sign(scheme, []byte("payload"), []byte("secret"), "1651406400")
+			if err != nil {
+				t.Fatalf("Failed to sign: %s", err)
+			}
+			if err := scheme.Validate(signature, []byte("payload"), []byte("secret"), "1651406400"); err != nil {
+				t.Fatalf("Failed to validate own signature %q: %s", signature, err)
+			}
+			if err := scheme.Validate(signature, []byte("payload"), []byte("other"), "1651406400"); err == nil {
+				t.Fatalf("Expected a different secret to fail")
+			}
+		})
+	}
+
+	if _, err := Sign(Scheme{Algorithm: "md5"}, []byte("payload"), []byte("secret")); err == nil {
+		t.Fatalf("Expected an unsupported algorithm to fail")
+	}
+}
+
+func TestValidateSignatureKeys(t *testing.T) {
+	keys := []Key{
+		{ID: "old", Secret: []byte("previous")},
+		{ID: "new", Secret: []byte("secret")},
+	}
+	key, err := ValidateSignatureKeys("sha1", "sha1="+sha1Hex, []byte("hello"), keys)
+	if err != nil {
+		t.Fatalf("Failed to validate rotated signature: %s", err)
+	}
+	if key.ID != "new" {
+		t.Fatalf("Unexpected key matched: %s", key.ID)
+	}
+
+	if _, err := ValidateSignatureKeys("sha1", "sha1="+sha1Hex, []byte("hello"), keys[:1]); err == nil {
+		t.Fatalf("Expected retired key to fail")
+	}
+	if _, err := Github.ValidateKeys("sha256=00", []byte("hello"), nil); err == nil {
+		t.Fatalf("Expected no keys to fail")
+	}
+}
@@ -0,0 +1,138 @@
+package oidc_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/threecommaio/opc/core/oidc"
+)
+
+// tokenServer fakes the github, sts and iam credentials endpoints
+type tokenServer struct {
+	github, sts, iam http.HandlerFunc
+}
+
+// start serves the endpoints and returns a client and request using them
+func (s tokenServer) start(t *testing.T) (*oidc.Client, oidc.WorkloadIdentityRequest) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/github", s.github)
+	mux.HandleFunc("/sts", s.sts)
+	mux.HandleFunc("/iam/", s.iam)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	client := &oidc.Client{HTTPClient: srv.Client(), STSURL: srv.URL + "/sts", IAMCredentialsURL: srv.URL + "/iam/"}
+	req := oidc.WorkloadIdentityRequest{
+		OIDCRequestURL:           srv.URL + "/github?api-version=2.0",
+		OIDCRequestToken:         "request-token",
+		WorkloadIdentityProvider: WorkloadIdentityProvider,
+		ServiceAccount:           ServiceAccount,
+		IDTokenAudience:          "https://api.example.com",
+	}
+
+	return client, req
+}
+
+// reply returns a handler writing status and body
+func reply(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", oidc.ApplicationJSON)
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+func TestWorkloadIdentityToken(t *testing.T) {
+	ok := tokenServer{
+		github: func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer request-token" {
+				t.Errorf("Unexpected authorization: %s", r.Header.Get("Authorization"))
+			}
+			if !strings.HasSuffix(r.URL.Query().Get("audience"), WorkloadIdentityProvider) {
+				t.Errorf("Unexpected audience: %s", r.URL.Query().Get("audience"))
+			}
+			reply(http.StatusOK, `{"count":1,"value":"github-token"}`)(w, r)
+		},
+		sts: func(w http.ResponseWriter, r *http.Request) {
+			var body oidc.RequestAccessToken
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.SubjectToken != "github-token" {
+				t.Errorf("Unexpected sts request: %+v %v", body, err)
+			}
+			reply(http.StatusOK, `{"access_token":"access-token"}`)(w, r)
+		},
+		iam: func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/iam/projects/-/serviceAccounts/"+ServiceAccount+":generateIdToken" {
+				t.Errorf("Unexpected path: %s", r.URL.Path)
+			}
+			if r.Header.Get("Authorization") != "Bearer access-token" {
+				t.Errorf("Unexpected authorization: %s", r.Header.Get("Authorization"))
+			}
+			var body oidc.TokenRequest
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !body.IncludeEmail {
+				t.Errorf("Unexpected iam request: %+v %v", body, err)
+			}
+			reply(http.StatusOK, `{"token":"id-token"}`)(w, r)
+		},
+	}
+	client, req := ok.start(t)
+	token, err := client.WorkloadIdentityToken(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Failed to get token: %s", err)
+	}
+	if token != "id-token" {
+		t.Fatalf("Unexpected token: %s", token)
+	}
+}
+
+func TestWorkloadIdentityTokenErrors(t *testing.T) {
+	success := reply(http.StatusOK, `{"count":1,"value":"github-token","access_token":"access-token","token":"id-token"}`)
+	tests := []struct {
+		name        string
+		server      tokenServer
+		status      int
+		code        string
+		description string
+		err         error
+	}{
+		{"github unavailable", tokenServer{github: reply(http.StatusServiceUnavailable, "upstream down"), sts: success, iam: success},
+			http.StatusServiceUnavailable, "", "", nil},
+		{"sts forbidden", tokenServer{github: success, iam: success, sts: reply(http.StatusForbidden,
+			`{"error":"invalid_grant","error_description":"The audience in ID Token does not match"}`)},
+			http.StatusForbidden, "invalid_grant", "The audience in ID Token does not match", nil},
+		{"iam permission denied", tokenServer{github: success, sts: success, iam: reply(http.StatusForbidden,
+			`{"error":{"code":403,"message":"Permission iam.serviceAccounts.getOpenIdToken denied","status":"PERMISSION_DENIED"}}`)},
+			http.StatusForbidden, "PERMISSION_DENIED", "Permission iam.serviceAccounts.getOpenIdToken denied", nil},
+		{"empty access token", tokenServer{github: success, iam: success, sts: reply(http.StatusOK, `{}`)},
+			0, "", "", oidc.ErrEmptyToken},
+		{"empty id token", tokenServer{github: success, sts: success, iam: reply(http.StatusOK, `{"token":""}`)},
+			0, "", "", oidc.ErrEmptyToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, req := tt.server.start(t)
+			_, err := client.WorkloadIdentityToken(context.Background(), req)
+			if err == nil {
+				t.Fatalf("Expected an error")
+			}
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Unexpected error: got %v, want %v", err, tt.err)
+				}
+				return
+			}
+			var apiErr *oidc.APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Expected an APIError, got %v", err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Code != tt.code || apiErr.Description != tt.description {
+				t.Fatalf("Unexpected error: %+v", apiErr)
+			}
+		})
+	}
+}
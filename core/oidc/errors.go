@@ -0,0 +1,73 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIError is a non 2xx response from a token endpoint
+type APIError struct {
+	// Endpoint is the service called, such as sts
+	Endpoint   string
+	StatusCode int
+	// Code is the provider's error, such as invalid_grant or PERMISSION_DENIED
+	Code        string
+	Description string
+	// Body is the raw response when it isn't an error document
+	Body string
+}
+
+// Error implements error
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s returned %d %s", e.Endpoint, e.StatusCode, http.StatusText(e.StatusCode))
+	switch {
+	case e.Code != "" && e.Description != "":
+		return msg + ": " + e.Code + ": " + e.Description
+	case e.Code != "":
+		return msg + ": " + e.Code
+	case e.Body != "":
+		return msg + ": " + e.Body
+	}
+
+	return msg
+}
+
+// newAPIError parses the oauth2 error document ({"error", "error_description"})
+// or the google api one ({"error": {"status", "message"}})
+func newAPIError(endpoint string, status int, body []byte) *APIError {
+	apiErr := &APIError{Endpoint: endpoint, StatusCode: status}
+
+	var doc struct {
+		Error            json.RawMessage `json:"error"`
+		ErrorDescription string          `json:"error_description"`
+		Message          string          `json:"message"`
+	}
+	if err := json.Unmarshal(body, &doc); err == nil && len(doc.Error) > 0 {
+		var code string
+		var googleErr struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		}
+		switch {
+		case json.Unmarshal(doc.Error, &code) == nil:
+			apiErr.Code = code
+			apiErr.Description = doc.ErrorDescription
+		case json.Unmarshal(doc.Error, &googleErr) == nil:
+			apiErr.Code = googleErr.Status
+			apiErr.Description = googleErr.Message
+		}
+		if apiErr.Description == "" {
+			apiErr.Description = doc.Message
+		}
+	}
+	if apiErr.Code == "" {
+		apiErr.Body = strings.TrimSpace(string(body))
+		if len(apiErr.Body) > 512 {
+			apiErr.Body = apiErr.Body[:512]
+		}
+	}
+
+	return apiErr
+}
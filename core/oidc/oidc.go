@@ -7,11 +7,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 
+	"github.com/threecommaio/opc/core/requestid"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
@@ -34,11 +37,16 @@ const (
 	AuthRequestTokenType = "urn:ietf:params:oauth:token-type:access_token"
 	AuthTokenScope       = "https://www.googleapis.com/auth/cloud-platform"
 	AuthSubjectTokenType = "urn:ietf:params:oauth:token-type:jwt"
+	IAMCredentialsURL    = "https://iamcredentials.googleapis.com/v1/"
+
+	// maxResponseSize limits how much of a token response is read
+	maxResponseSize = 1 << 20
 )
 
 // errors
 var (
-	ErrNoToken = errors.New("token did not contain an id_token")
+	ErrNoToken    = errors.New("token did not contain an id_token")
+	ErrEmptyToken = errors.New("provider returned an empty token")
 )
 
 // RequestAccessToken is the request payload for the OIDC token exchange
@@ -54,8 +62,9 @@ type RequestAccessToken struct {
 // TokenRequest is the token payload for the OIDC token exchange
 type TokenRequest struct {
 	Audience string `json:"audience,omitempty"`
-	// IncludeEmail bool     `json:"includeEmail,omitempty"`
-	Delegates []string `json:"delegates,omitempty"`
+	// IncludeEmail adds the email and email_verified claims of the service account
+	IncludeEmail bool     `json:"includeEmail,omitempty"`
+	Delegates    []string `json:"delegates,omitempty"`
 }
 
 // WorkloadIdentityRequest is the workload identity payload for the OIDC token exchange
@@ -68,9 +77,35 @@ type WorkloadIdentityRequest struct {
 	IDTokenAudience          string // https://demo-uc.a.run.app
 }
 
+// Client calls the github and google token endpoints, the zero value uses
+// requestid.Client and the google endpoints
+type Client struct {
+	HTTPClient *http.Client
+	// STSURL defaults to STSURL
+	STSURL string
+	// IAMCredentialsURL defaults to IAMCredentialsURL
+	IAMCredentialsURL string
+}
+
+// DefaultClient is used by the package level functions
+var DefaultClient = &Client{}
+
+// httpClient returns the configured client or requestid.Client
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+
+	return requestid.Client
+}
+
 // GetIDToken gets the ID token for the given service account
 func GetIDToken(ctx context.Context, requestURL, requestTokn, providerID string) (string, error) {
-	client := &http.Client{}
+	return DefaultClient.GetIDToken(ctx, requestURL, requestTokn, providerID)
+}
+
+// GetIDToken gets the github actions ID token for the workload identity provider
+func (c *Client) GetIDToken(ctx context.Context, requestURL, requestToken, providerID string) (string, error) {
 	audience := `https://iam.googleapis.com/` + providerID
 	requestURL = requestURL + "&audience=" + audience
 
@@ -78,19 +113,17 @@ func GetIDToken(ctx context.Context, requestURL, requestTokn, providerID string)
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %w", err)
 	}
-	req.Header.Add("Authorization", "Bearer "+requestTokn)
+	req.Header.Add("Authorization", "Bearer "+requestToken)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to get ID token: %w", err)
-	}
-	defer resp.Body.Close()
 	var payload struct {
 		Count int    `json:"count"`
 		Value string `json:"value"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return "", fmt.Errorf("failed to decode ID token: %w", err)
+	if err := c.do(req, "github oidc", &payload); err != nil {
+		return "", fmt.Errorf("failed to get ID token: %w", err)
+	}
+	if payload.Value == "" {
+		return "", fmt.Errorf("failed to get ID token: %w", ErrEmptyToken)
 	}
 
 	return payload.Value, nil
@@ -98,6 +131,11 @@ func GetIDToken(ctx context.Context, requestURL, requestTokn, providerID string)
 
 // GetAuthToken gets the auth token for the given service account
 func GetAuthToken(ctx context.Context, providerID, token string) (string, error) {
+	return DefaultClient.GetAuthToken(ctx, providerID, token)
+}
+
+// GetAuthToken exchanges the github ID token for a google access token
+func (c *Client) GetAuthToken(ctx context.Context, providerID, token string) (string, error) {
 	raToken := RequestAccessToken{
 		Audience:           AuthAudience + providerID,
 		GrantType:          AuthGrantType,
@@ -111,29 +149,25 @@ func GetAuthToken(ctx context.Context, providerID, token string) (string, error)
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal request access token: %w", err)
 	}
-	client := &http.Client{}
-	req, err := http.NewRequestWithContext(ctx, "POST", STSURL, bytes.NewBuffer(jsonBody))
+	stsURL := c.STSURL
+	if stsURL == "" {
+		stsURL = STSURL
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", stsURL, bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Add("Content-Type", ApplicationJSON)
 	req.Header.Add("Accept", ApplicationJSON)
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to get auth token: %w", err)
-	}
 
 	var rat struct {
 		AccessToken string `json:"access_token"`
 	}
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %w", err)
+	if err := c.do(req, "sts", &rat); err != nil {
+		return "", fmt.Errorf("failed to get auth token: %w", err)
 	}
-	defer resp.Body.Close()
-
-	if err := json.NewDecoder(bytes.NewBuffer(data)).Decode(&rat); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+	if rat.AccessToken == "" {
+		return "", fmt.Errorf("failed to get auth token: %w", ErrEmptyToken)
 	}
 
 	return rat.AccessToken, nil
@@ -141,11 +175,22 @@ func GetAuthToken(ctx context.Context, providerID, token string) (string, error)
 
 // GoogleIDToken is the ID token for a Google service account
 func GoogleIDToken(ctx context.Context, token, sa, audience string) (string, error) {
+	return DefaultClient.GoogleIDToken(ctx, token, sa, audience)
+}
+
+// GoogleIDToken generates an ID token for the service account sa including its email
+func (c *Client) GoogleIDToken(ctx context.Context, token, sa, audience string) (string, error) {
+	baseURL := c.IAMCredentialsURL
+	if baseURL == "" {
+		baseURL = IAMCredentialsURL
+	}
 	serviceAccountID := `projects/-/serviceAccounts/` + sa
-	tokenURL := `https://iamcredentials.googleapis.com/v1/` + serviceAccountID + `:generateIdToken`
+	tokenURL := strings.TrimSuffix(baseURL, "/") + "/" + serviceAccountID + `:generateIdToken`
 
+	// receivers allowlist callers by email, see web.BearerAuth
 	it := TokenRequest{
-		Audience: audience,
+		Audience:     audience,
+		IncludeEmail: true,
 	}
 
 	jsonBody, err := json.MarshalIndent(it, "", "  ")
@@ -153,7 +198,6 @@ func GoogleIDToken(ctx context.Context, token, sa, audience string) (string, err
 		return "", fmt.Errorf("failed to marshal id token: %w", err)
 	}
 
-	client := &http.Client{}
 	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %w", err)
@@ -162,23 +206,14 @@ func GoogleIDToken(ctx context.Context, token, sa, audience string) (string, err
 	req.Header.Add("Content-Type", ApplicationJSON)
 	req.Header.Add("Accept", ApplicationJSON)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to get id token: %w", err)
-	}
-
 	var payload struct {
 		Token string `json:"token,omitempty"`
 	}
-
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %w", err)
+	if err := c.do(req, "iam credentials", &payload); err != nil {
+		return "", fmt.Errorf("failed to get id token: %w", err)
 	}
-	defer resp.Body.Close()
-
-	if err := json.NewDecoder(bytes.NewBuffer(data)).Decode(&payload); err != nil {
-		return "", fmt.Errorf("failed to decode response body: %w", err)
+	if payload.Token == "" {
+		return "", fmt.Errorf("failed to get id token: %w", ErrEmptyToken)
 	}
 
 	return payload.Token, nil
@@ -186,16 +221,21 @@ func GoogleIDToken(ctx context.Context, token, sa, audience string) (string, err
 
 // WorkloadIdentityToken gets the ID token thats required to hit an authenticated endpoint
 func WorkloadIdentityToken(ctx context.Context, req WorkloadIdentityRequest) (string, error) {
-	oidcToken, err := GetIDToken(ctx, req.OIDCRequestURL, req.OIDCRequestToken,
+	return DefaultClient.WorkloadIdentityToken(ctx, req)
+}
+
+// WorkloadIdentityToken gets the ID token thats required to hit an authenticated endpoint
+func (c *Client) WorkloadIdentityToken(ctx context.Context, req WorkloadIdentityRequest) (string, error) {
+	oidcToken, err := c.GetIDToken(ctx, req.OIDCRequestURL, req.OIDCRequestToken,
 		req.WorkloadIdentityProvider)
 	if err != nil {
 		return "", err
 	}
-	accessToken, err := GetAuthToken(ctx, req.WorkloadIdentityProvider, oidcToken)
+	accessToken, err := c.GetAuthToken(ctx, req.WorkloadIdentityProvider, oidcToken)
 	if err != nil {
 		return "", err
 	}
-	idToken, err := GoogleIDToken(ctx, accessToken, req.ServiceAccount, req.IDTokenAudience)
+	idToken, err := c.GoogleIDToken(ctx, accessToken, req.ServiceAccount, req.IDTokenAudience)
 	if err != nil {
 		return "", err
 	}
@@ -203,6 +243,29 @@ func WorkloadIdentityToken(ctx context.Context, req WorkloadIdentityRequest) (st
 	return idToken, nil
 }
 
+// do sends req and decodes the json response into v, non 2xx responses are
+// returned as *APIError
+func (c *Client) do(req *http.Request, endpoint string, v interface{}) error {
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newAPIError(endpoint, resp.StatusCode, data)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return nil
+}
+
 // NewProxy takes target host and creates a reverse proxy
 func NewProxy(ctx context.Context, targetHost string) (*httputil.ReverseProxy, error) {
 	tr, err := NewTransport(ctx)
@@ -255,7 +318,7 @@ func NewTransport(ctx context.Context) (http.RoundTripper, error) {
 
 	opts := make([]option.ClientOption, 0, 2)
 	opts = append(opts, option.WithTokenSource(ts), internaloption.SkipDialSettingsValidation())
-	t, err := htransport.NewTransport(ctx, http.DefaultTransport, opts...)
+	t, err := htransport.NewTransport(ctx, requestid.NewTransport(http.DefaultTransport), opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create transport: %w", err)
 	}
@@ -7,6 +7,7 @@ import (
 	"os"
 
 	"github.com/threecommaio/opc/core/oidc"
+	"golang.org/x/oauth2"
 )
 
 const (
@@ -62,3 +63,25 @@ func Example_cloudRun() {
 	}
 	defer resp.Body.Close()
 }
+
+// Reuse the ID token across many requests to a CloudRun service
+func Example_tokenSource() {
+	idTokenAudience := "https://helloworld-snjhz2q4pa-uc.a.run.app"
+	ts := oidc.WorkloadIdentityTokenSource(context.Background(), oidc.WorkloadIdentityRequest{
+		OIDCRequestURL:           os.Getenv(oidc.ActionsIDTokenRequestURL),
+		OIDCRequestToken:         os.Getenv(oidc.ActionsIDTokenRequestToken),
+		WorkloadIdentityProvider: WorkloadIdentityProvider,
+		ServiceAccount:           ServiceAccount,
+		IDTokenAudience:          idTokenAudience,
+	})
+
+	// the transport sets the authorization header, fetching a token only when needed
+	client := &http.Client{Transport: &oauth2.Transport{Source: ts}}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(idTokenAudience + "/api/v1/hello")
+		if err != nil {
+			panic(err)
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,102 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// DefaultTokenRefreshMargin is how long before exp a cached ID token is refreshed
+const DefaultTokenRefreshMargin = 5 * time.Minute
+
+// workloadIdentityTokenSource caches the ID token from WorkloadIdentityToken
+type workloadIdentityTokenSource struct {
+	ctx    context.Context
+	req    WorkloadIdentityRequest
+	margin time.Duration
+	fetch  func(ctx context.Context, req WorkloadIdentityRequest) (string, error)
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+// WorkloadIdentityTokenSource returns a token source caching the ID token from
+// WorkloadIdentityToken until DefaultTokenRefreshMargin before it expires. It
+// is safe for concurrent use, concurrent callers share a single refresh. ctx
+// is used for every refresh.
+func WorkloadIdentityTokenSource(ctx context.Context, req WorkloadIdentityRequest) oauth2.TokenSource {
+	return DefaultClient.WorkloadIdentityTokenSource(ctx, req)
+}
+
+// WorkloadIdentityTokenSource returns a caching token source using c
+func (c *Client) WorkloadIdentityTokenSource(ctx context.Context, req WorkloadIdentityRequest) oauth2.TokenSource {
+	return &workloadIdentityTokenSource{
+		ctx:    ctx,
+		req:    req,
+		margin: DefaultTokenRefreshMargin,
+		fetch:  c.WorkloadIdentityToken,
+	}
+}
+
+// Token returns the cached ID token or fetches a new one, a failed refresh
+// keeps returning the cached token until it expires
+func (s *workloadIdentityTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != nil && timeNow().Add(s.margin).Before(s.token.Expiry) {
+		return s.token, nil
+	}
+
+	token, err := s.refresh()
+	if err != nil {
+		// the cached token is still good, the next call retries the refresh
+		if s.token != nil && timeNow().Before(s.token.Expiry) {
+			return s.token, nil
+		}
+		return nil, err
+	}
+	s.token = token
+
+	return s.token, nil
+}
+
+// refresh fetches a new ID token
+func (s *workloadIdentityTokenSource) refresh() (*oauth2.Token, error) {
+	idToken, err := s.fetch(s.ctx, s.req)
+	if err != nil {
+		return nil, err
+	}
+	expiry, err := tokenExpiry(idToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Token{
+		AccessToken: idToken,
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}, nil
+}
+
+// tokenExpiry reads exp from a JWT without verifying it, the token comes
+// straight from google over tls
+func tokenExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, ErrMalformedToken
+	}
+	claims, err := parseClaims(parts[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+	if claims.Expiry.IsZero() {
+		return time.Time{}, fmt.Errorf("%w: missing exp", ErrMalformedToken)
+	}
+
+	return claims.Expiry, nil
+}
@@ -0,0 +1,85 @@
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// unsignedToken creates a token with an exp claim
+func unsignedToken(exp time.Time) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	payload, _ := json.Marshal(map[string]interface{}{"exp": exp.Unix()})
+
+	return enc([]byte(`{"alg":"RS256"}`)) + "." + enc(payload) + ".c2ln"
+}
+
+func TestWorkloadIdentityTokenSource(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	fixedNow(t, now)
+	var fetches int32
+	ts := WorkloadIdentityTokenSource(context.Background(), WorkloadIdentityRequest{}).(*workloadIdentityTokenSource)
+	ts.fetch = func(ctx context.Context, req WorkloadIdentityRequest) (string, error) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(10 * time.Millisecond)
+
+		return unsignedToken(now.Add(time.Hour)), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := ts.Token()
+			if err != nil {
+				t.Errorf("Failed to get token: %s", err)
+				return
+			}
+			if !token.Expiry.Equal(now.Add(time.Hour)) || token.TokenType != "Bearer" {
+				t.Errorf("Unexpected token: %+v", token)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("Concurrent callers should share a fetch, got %d", n)
+	}
+
+	// refreshed once inside the margin before exp
+	fixedNow(t, now.Add(time.Hour-DefaultTokenRefreshMargin+time.Second))
+	if _, err := ts.Token(); err != nil {
+		t.Fatalf("Failed to refresh token: %s", err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatalf("Expected a refresh, got %d fetches", n)
+	}
+
+	// a failed refresh inside the margin serves the cached token until exp
+	errSTS := errors.New("sts unavailable")
+	cached := ts.token
+	ts.fetch = func(ctx context.Context, req WorkloadIdentityRequest) (string, error) {
+		return "", errSTS
+	}
+	fixedNow(t, cached.Expiry.Add(-time.Second))
+	if token, err := ts.Token(); err != nil || token != cached {
+		t.Fatalf("Expected the cached token, got %+v %v", token, err)
+	}
+	fixedNow(t, cached.Expiry)
+	if _, err := ts.Token(); !errors.Is(err, errSTS) {
+		t.Fatalf("Unexpected error after expiry: %v", err)
+	}
+
+	ts.token = nil
+	ts.fetch = func(ctx context.Context, req WorkloadIdentityRequest) (string, error) {
+		return "opaque", nil
+	}
+	if _, err := ts.Token(); !errors.Is(err, ErrMalformedToken) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
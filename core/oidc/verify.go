@@ -0,0 +1,478 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/threecommaio/opc/core/requestid"
+)
+
+// well known issuers and their key sets
+const (
+	GoogleIssuer         = "https://accounts.google.com"
+	GoogleJWKSURL        = "https://www.googleapis.com/oauth2/v3/certs"
+	GithubActionsIssuer  = "https://token.actions.githubusercontent.com"
+	GithubActionsJWKSURL = "https://token.actions.githubusercontent.com/.well-known/jwks"
+
+	// DefaultLeeway is the allowed clock skew for exp, nbf and iat
+	DefaultLeeway = time.Minute
+	// DefaultKeyCacheTTL is how long keys are cached without a max-age from the issuer
+	DefaultKeyCacheTTL = time.Hour
+	// minKeyRefresh limits refetching the key set
+	minKeyRefresh = time.Minute
+	// keyFetchTimeout bounds a key set fetch
+	keyFetchTimeout = 10 * time.Second
+)
+
+// errors
+var (
+	ErrVerifierConfig    = errors.New("verifier needs a jwks url, issuer and audience")
+	ErrMalformedToken    = errors.New("malformed token")
+	ErrUnsupportedAlg    = errors.New("unsupported signing algorithm")
+	ErrUnknownKey        = errors.New("unknown signing key")
+	ErrInvalidSignature  = errors.New("invalid token signature")
+	ErrTokenExpired      = errors.New("token is expired")
+	ErrTokenNotYetValid  = errors.New("token is not valid yet")
+	ErrInvalidIssuer     = errors.New("invalid token issuer")
+	ErrInvalidAudience   = errors.New("invalid token audience")
+	ErrKeySetUnavailable = errors.New("failed to fetch key set")
+)
+
+// timeNow is replaced in tests
+var timeNow = time.Now
+
+// Claims are the verified claims of a token, Raw holds every claim including
+// issuer specific ones such as repository for github actions
+type Claims struct {
+	Issuer        string
+	Subject       string
+	Audience      []string
+	Expiry        time.Time
+	IssuedAt      time.Time
+	NotBefore     time.Time
+	Email         string
+	EmailVerified bool
+	Raw           map[string]interface{}
+}
+
+// VerifierConfig configures a Verifier
+type VerifierConfig struct {
+	JWKSURL string
+	// Issuers accepted in iss, google uses both accounts.google.com and https://accounts.google.com
+	Issuers []string
+	// Audiences of which one must be in aud, for cloud run the service url
+	Audiences []string
+	// Leeway defaults to DefaultLeeway
+	Leeway time.Duration
+	// Client fetches the key set, defaults to requestid.Client
+	Client *http.Client
+}
+
+// Verifier verifies RS256 and ES256 signed JWTs against a JWKS
+type Verifier struct {
+	cfg  VerifierConfig
+	keys *keySet
+}
+
+// NewVerifier creates a verifier, keys are fetched on first use
+func NewVerifier(cfg VerifierConfig) (*Verifier, error) {
+	if cfg.JWKSURL == "" || len(cfg.Issuers) == 0 || len(cfg.Audiences) == 0 {
+		return nil, ErrVerifierConfig
+	}
+	if cfg.Leeway == 0 {
+		cfg.Leeway = DefaultLeeway
+	}
+	if cfg.Client == nil {
+		cfg.Client = requestid.Client
+	}
+
+	return &Verifier{cfg: cfg, keys: &keySet{url: cfg.JWKSURL, client: cfg.Client}}, nil
+}
+
+// GoogleVerifier verifies google ID tokens such as the ones from WorkloadIdentityToken
+func GoogleVerifier(audiences ...string) (*Verifier, error) {
+	return NewVerifier(VerifierConfig{
+		JWKSURL:   GoogleJWKSURL,
+		Issuers:   []string{GoogleIssuer, "accounts.google.com"},
+		Audiences: audiences,
+	})
+}
+
+// Verify checks the signature, issuer, audience and validity period of token
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformedToken, err)
+	}
+	key, err := v.keys.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	claims, err := parseClaims(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// validate checks the registered claims
+func (v *Verifier) validate(claims *Claims) error {
+	now := timeNow()
+	if claims.Expiry.IsZero() || now.After(claims.Expiry.Add(v.cfg.Leeway)) {
+		return fmt.Errorf("%w: expired at %s", ErrTokenExpired, claims.Expiry.UTC().Format(time.RFC3339))
+	}
+	if !claims.NotBefore.IsZero() && now.Add(v.cfg.Leeway).Before(claims.NotBefore) {
+		return ErrTokenNotYetValid
+	}
+	if !claims.IssuedAt.IsZero() && now.Add(v.cfg.Leeway).Before(claims.IssuedAt) {
+		return ErrTokenNotYetValid
+	}
+	if !contains(v.cfg.Issuers, claims.Issuer) {
+		return fmt.Errorf("%w: %q", ErrInvalidIssuer, claims.Issuer)
+	}
+	for _, aud := range claims.Audience {
+		if contains(v.cfg.Audiences, aud) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %q", ErrInvalidAudience, claims.Audience)
+}
+
+// contains reports whether s is in list
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decodeSegment decodes a base64url json segment
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrMalformedToken, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %s", ErrMalformedToken, err)
+	}
+
+	return nil
+}
+
+// parseClaims decodes the payload, aud may be a string or a list
+func parseClaims(segment string) (*Claims, error) {
+	raw := make(map[string]interface{})
+	if err := decodeSegment(segment, &raw); err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{Raw: raw}
+	claims.Issuer, _ = raw["iss"].(string)
+	claims.Subject, _ = raw["sub"].(string)
+	claims.Email, _ = raw["email"].(string)
+	switch verified := raw["email_verified"].(type) {
+	case bool:
+		claims.EmailVerified = verified
+	case string:
+		claims.EmailVerified, _ = strconv.ParseBool(verified)
+	}
+	switch aud := raw["aud"].(type) {
+	case string:
+		claims.Audience = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				claims.Audience = append(claims.Audience, s)
+			}
+		}
+	}
+	claims.Expiry = numericDate(raw["exp"])
+	claims.IssuedAt = numericDate(raw["iat"])
+	claims.NotBefore = numericDate(raw["nbf"])
+
+	return claims, nil
+}
+
+// numericDate converts seconds since the epoch, missing values are zero
+func numericDate(v interface{}) time.Time {
+	seconds, ok := v.(float64)
+	if !ok {
+		return time.Time{}
+	}
+
+	return time.Unix(int64(seconds), 0)
+}
+
+// verifySignature checks a RS256 or ES256 signature
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: key does not match %s", ErrInvalidSignature, alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return ErrInvalidSignature
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return fmt.Errorf("%w: key does not match %s", ErrInvalidSignature, alg)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return ErrInvalidSignature
+		}
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedAlg, alg)
+	}
+
+	return nil
+}
+
+// keySet caches the keys of a JWKS url, keys are refetched when the cache
+// expires or a token names an unknown key id, which is how issuers rotate.
+// A single fetch runs at a time outside the lock and at most once per
+// minKeyRefresh, in between expired keys keep being served.
+type keySet struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	expires   time.Time
+	fetchedAt time.Time
+	fetchErr  error
+	// inflight is closed when the running fetch finishes
+	inflight chan struct{}
+}
+
+// key returns the key for kid, an empty kid matches a key set with a single key
+func (k *keySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	now := timeNow()
+	key, ok := k.lookup(kid)
+	if ok && now.Before(k.expires) {
+		k.mu.Unlock()
+		return key, nil
+	}
+	wait := k.inflight
+	if wait == nil {
+		if now.Sub(k.fetchedAt) < minKeyRefresh {
+			fetchErr := k.fetchErr
+			k.mu.Unlock()
+			if ok {
+				return key, nil
+			}
+			// an unknown key may be one the issuer couldn't be asked about
+			if fetchErr != nil {
+				return nil, fetchErr
+			}
+
+			return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+		}
+		wait = make(chan struct{})
+		k.inflight = wait
+		k.fetchedAt = now
+		go k.refresh(wait)
+	}
+	k.mu.Unlock()
+
+	select {
+	case <-wait:
+	case <-ctx.Done():
+		if ok {
+			return key, nil
+		}
+
+		return nil, ctx.Err()
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if fresh, found := k.lookup(kid); found {
+		return fresh, nil
+	}
+	// keep serving cached keys while the issuer is unavailable
+	if k.fetchErr != nil {
+		if ok {
+			return key, nil
+		}
+
+		return nil, k.fetchErr
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+}
+
+// lookup finds kid in the cached keys
+func (k *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+
+	return key, ok
+}
+
+// refresh fetches the key set and closes done, it isn't tied to the context
+// of the request that started it as other requests wait on it too
+func (k *keySet) refresh(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), keyFetchTimeout)
+	defer cancel()
+	keys, ttl, err := k.fetch(ctx)
+
+	k.mu.Lock()
+	if err == nil {
+		k.keys = keys
+		k.expires = timeNow().Add(ttl)
+	}
+	k.fetchErr = err
+	k.inflight = nil
+	k.mu.Unlock()
+	close(done)
+}
+
+// fetch downloads the key set and returns its keys and cache ttl
+func (k *keySet) fetch(ctx context.Context) (map[string]crypto.PublicKey, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", ApplicationJSON)
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrKeySetUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%w: %s", ErrKeySetUnavailable, resp.Status)
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrKeySetUnavailable, err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, j := range jwks.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		key, err := j.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[j.Kid] = key
+	}
+
+	return keys, maxAge(resp.Header.Get("Cache-Control")), nil
+}
+
+// maxAge returns the max-age of a Cache-Control header or DefaultKeyCacheTTL
+func maxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	return DefaultKeyCacheTTL
+}
+
+// jwk is a json web key, only RSA and P-256 keys are supported
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes the key
+func (j jwk) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(j.N)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(j.E)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode exponent: %w", err)
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, fmt.Errorf("%w: curve %s", ErrUnsupportedAlg, j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode x: %w", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(j.Y)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode y: %w", err)
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("%w: point is not on the curve", ErrUnsupportedAlg)
+		}
+
+		return pub, nil
+	}
+
+	return nil, fmt.Errorf("%w: key type %s", ErrUnsupportedAlg, j.Kty)
+}
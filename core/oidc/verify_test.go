@@ -0,0 +1,302 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testKey is a signing key served by a testJWKS
+type testKey struct {
+	kid string
+	key crypto.Signer
+}
+
+// sign creates a token signed with k
+func (k testKey) sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	alg := "RS256"
+	if _, ok := k.key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": k.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := k.key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("Failed to sign: %s", err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatalf("Failed to sign: %s", err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// jwk returns the public json web key
+func (k testKey) jwk() map[string]string {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch pub := k.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": k.kid, "use": "sig",
+			"n": enc(pub.N.Bytes()), "e": enc(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": k.kid, "crv": "P-256",
+			"x": enc(pub.X.FillBytes(make([]byte, 32))), "y": enc(pub.Y.FillBytes(make([]byte, 32)))}
+	}
+
+	return nil
+}
+
+// testJWKS serves the current keys and counts fetches
+type testJWKS struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    []testKey
+	fetches int32
+	// down makes fetches wait for it to be closed and fail
+	down chan struct{}
+}
+
+// newTestJWKS starts a key set server
+func newTestJWKS(t *testing.T, keys ...testKey) *testJWKS {
+	t.Helper()
+	j := &testJWKS{keys: keys}
+	j.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&j.fetches, 1)
+		j.mu.Lock()
+		down := j.down
+		j.mu.Unlock()
+		if down != nil {
+			<-down
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		set := make([]map[string]string, 0, len(j.keys))
+		for _, k := range j.keys {
+			set = append(set, k.jwk())
+		}
+		w.Header().Set("Cache-Control", "public, max-age=600")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": set})
+	}))
+	t.Cleanup(j.Close)
+
+	return j
+}
+
+// rotate replaces the served keys
+func (j *testJWKS) rotate(keys ...testKey) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys = keys
+}
+
+func newRSAKey(t *testing.T, kid string) testKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+
+	return testKey{kid: kid, key: key}
+}
+
+func newECKey(t *testing.T, kid string) testKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+
+	return testKey{kid: kid, key: key}
+}
+
+// fixedNow pins timeNow for the duration of the test
+func fixedNow(t *testing.T, now time.Time) {
+	t.Helper()
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	fixedNow(t, now)
+	rsaKey, ecKey := newRSAKey(t, "rsa"), newECKey(t, "ec")
+	jwks := newTestJWKS(t, rsaKey, ecKey)
+	v, err := NewVerifier(VerifierConfig{
+		JWKSURL: jwks.URL, Issuers: []string{GoogleIssuer}, Audiences: []string{"https://api.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %s", err)
+	}
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": GoogleIssuer, "aud": "https://api.example.com", "sub": "1234",
+			"email": "svc@my-project.iam.gserviceaccount.com", "email_verified": true,
+			"iat": now.Unix(), "exp": now.Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+
+		return c
+	}
+	tampered := rsaKey.sign(t, claims(nil))
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"rs256", rsaKey.sign(t, claims(nil)), nil},
+		{"es256", ecKey.sign(t, claims(nil)), nil},
+		{"audience list", rsaKey.sign(t, claims(map[string]interface{}{
+			"aud": []string{"other", "https://api.example.com"}})), nil},
+		{"within leeway", rsaKey.sign(t, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})), nil},
+		{"expired", rsaKey.sign(t, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), ErrTokenExpired},
+		{"no expiry", rsaKey.sign(t, claims(map[string]interface{}{"exp": nil})), ErrTokenExpired},
+		{"not yet valid", rsaKey.sign(t, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})), ErrTokenNotYetValid},
+		{"issuer", rsaKey.sign(t, claims(map[string]interface{}{"iss": "https://evil.example.com"})), ErrInvalidIssuer},
+		{"audience", rsaKey.sign(t, claims(map[string]interface{}{"aud": "https://other.example.com"})), ErrInvalidAudience},
+		{"signature", tampered, ErrInvalidSignature},
+		{"unknown key", testKey{kid: "other", key: rsaKey.key}.sign(t, claims(nil)), ErrUnknownKey},
+		{"none", "eyJhbGciOiJub25lIiwia2lkIjoicnNhIn0.e30.", ErrUnsupportedAlg},
+		{"malformed", "not-a-token", ErrMalformedToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := v.Verify(context.Background(), tt.token)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Unexpected error: got %v, want %v", err, tt.err)
+			}
+			if err == nil && (c.Subject != "1234" || !c.EmailVerified) {
+				t.Fatalf("Unexpected claims: %+v", c)
+			}
+		})
+	}
+	if n := atomic.LoadInt32(&jwks.fetches); n != 1 {
+		t.Fatalf("Keys should be cached, got %d fetches", n)
+	}
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	fixedNow(t, now)
+	oldKey, newKey := newRSAKey(t, "old"), newRSAKey(t, "new")
+	jwks := newTestJWKS(t, oldKey)
+	v, err := NewVerifier(VerifierConfig{JWKSURL: jwks.URL, Issuers: []string{"iss"}, Audiences: []string{"aud"}})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %s", err)
+	}
+	claims := map[string]interface{}{"iss": "iss", "aud": "aud", "sub": "s", "exp": now.Add(time.Hour).Unix()}
+
+	if _, err := v.Verify(context.Background(), oldKey.sign(t, claims)); err != nil {
+		t.Fatalf("Failed to verify: %s", err)
+	}
+
+	// a new key id is fetched once the refresh interval has passed
+	jwks.rotate(oldKey, newKey)
+	if _, err := v.Verify(context.Background(), newKey.sign(t, claims)); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Expected refetching to be rate limited, got %v", err)
+	}
+	now = now.Add(minKeyRefresh)
+	fixedNow(t, now)
+	if _, err := v.Verify(context.Background(), newKey.sign(t, claims)); err != nil {
+		t.Fatalf("Failed to verify rotated key: %s", err)
+	}
+
+	// retired keys are dropped when the cache expires
+	jwks.rotate(newKey)
+	fixedNow(t, now.Add(time.Hour))
+	claims["exp"] = now.Add(2 * time.Hour).Unix()
+	if _, err := v.Verify(context.Background(), oldKey.sign(t, claims)); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Expected the retired key to be rejected, got %v", err)
+	}
+	if n := atomic.LoadInt32(&jwks.fetches); n != 3 {
+		t.Fatalf("Unexpected fetches: %d", n)
+	}
+}
+
+func TestVerifyKeySetUnavailable(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	fixedNow(t, now)
+	key := newRSAKey(t, "rsa")
+	jwks := newTestJWKS(t, key)
+	v, err := NewVerifier(VerifierConfig{JWKSURL: jwks.URL, Issuers: []string{"iss"}, Audiences: []string{"aud"}})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %s", err)
+	}
+	token := key.sign(t, map[string]interface{}{"iss": "iss", "aud": "aud", "exp": now.Add(2 * time.Hour).Unix()})
+	if _, err := v.Verify(context.Background(), token); err != nil {
+		t.Fatalf("Failed to verify: %s", err)
+	}
+
+	// the cache expires while the issuer hangs, requests share one fetch and
+	// fall back to the expired keys instead of queueing behind it
+	down := make(chan struct{})
+	jwks.mu.Lock()
+	jwks.down = down
+	jwks.mu.Unlock()
+	fixedNow(t, now.Add(time.Hour))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if _, err := v.Verify(ctx, token); err != nil {
+				t.Errorf("Expected the expired key to be served: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(down)
+
+	// once the fetch failed the expired keys are served until the next refresh
+	deadline := time.Now().Add(time.Second)
+	for {
+		v.keys.mu.Lock()
+		done := v.keys.inflight == nil
+		v.keys.mu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := v.Verify(context.Background(), token); err != nil {
+		t.Fatalf("Expected the expired key to be served: %s", err)
+	}
+	if n := atomic.LoadInt32(&jwks.fetches); n != 2 {
+		t.Fatalf("Unexpected fetches: %d", n)
+	}
+}
@@ -0,0 +1,116 @@
+// Package requestid correlates a request with its logs and the outbound calls it makes
+package requestid
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/muyo/sno"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Header carries the request id between services
+	Header = "X-Request-ID"
+
+	// Field is the logrus field holding the request id
+	Field = "request_id"
+
+	// ClientTimeout bounds requests made with Client
+	ClientTimeout = 30 * time.Second
+
+	// maxLength bounds ids accepted from clients
+	maxLength = 128
+)
+
+type contextKey struct{}
+
+// New generates a request id
+func New() string {
+	return sno.New(0).String()
+}
+
+// Valid reports whether an id received from a client is safe to log and forward
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// NewContext returns a context carrying the request id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request id carried by ctx
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(contextKey{}).(string)
+
+	return id, ok && id != ""
+}
+
+// Transport sets the request id header on outbound requests whose context
+// carries one
+type Transport struct {
+	// Base defaults to http.DefaultTransport
+	Base http.RoundTripper
+}
+
+// NewTransport wraps base, nil uses http.DefaultTransport
+func NewTransport(base http.RoundTripper) *Transport {
+	return &Transport{Base: base}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	id, ok := FromContext(req.Context())
+	if !ok || req.Header.Get(Header) != "" {
+		return base.RoundTrip(req)
+	}
+
+	// a RoundTripper must not modify the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set(Header, id)
+
+	return base.RoundTrip(req)
+}
+
+// Client is a shared client propagating request ids
+var Client = &http.Client{Transport: NewTransport(nil), Timeout: ClientTimeout}
+
+// Hook adds the request id to entries logged with a context carrying one,
+// such as log.WithContext(ctx).Info()
+type Hook struct{}
+
+// Levels implements logrus.Hook
+func (Hook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements logrus.Hook
+func (Hook) Fire(entry *log.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+	if id, ok := FromContext(entry.Context); ok {
+		entry.Data[Field] = id
+	}
+
+	return nil
+}
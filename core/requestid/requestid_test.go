@@ -0,0 +1,70 @@
+package requestid
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestTransport(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get(Header))
+	}))
+	defer srv.Close()
+
+	ctx := NewContext(context.Background(), "req-1")
+	for _, set := range []string{"", "explicit"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %s", err)
+		}
+		if set != "" {
+			req.Header.Set(Header, set)
+		}
+		resp, err := Client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %s", err)
+		}
+		resp.Body.Close()
+		if set == "" && req.Header.Get(Header) != "" {
+			t.Fatal("Transport modified the caller's request")
+		}
+	}
+
+	if strings.Join(got, ",") != "req-1,explicit" {
+		t.Fatalf("Unexpected request ids: %v", got)
+	}
+}
+
+func TestHook(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.AddHook(Hook{})
+
+	logger.WithContext(NewContext(context.Background(), "req-1")).Info("handled")
+	if !strings.Contains(buf.String(), `"request_id":"req-1"`) {
+		t.Fatalf("Request id missing from entry: %s", buf.String())
+	}
+}
+
+func TestValid(t *testing.T) {
+	for id, want := range map[string]bool{
+		"2VGkKu3cOvCN2ujl":                     true,
+		"0b8b5f2a-4f3c-4ac2-9a25-0ec0d5c7e9a1": true,
+		"":                                     false,
+		"bad id\nforged=1":                     false,
+		strings.Repeat("a", 129):               false,
+	} {
+		if Valid(id) != want {
+			t.Errorf("Valid(%q) = %t, want %t", id, !want, want)
+		}
+	}
+}
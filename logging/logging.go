@@ -12,6 +12,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/writer"
 	"github.com/threecommaio/opc/core"
+	"github.com/threecommaio/opc/core/requestid"
 )
 
 var (
@@ -57,6 +58,11 @@ func (h *ExtraFieldHook) Fire(entry *logrus.Entry) error {
 func Init(service, env string) error {
 	log.SetOutput(ioutil.Discard) // Send all logs to nowhere by default
 
+	// hooks run in the order they are added, fields must be set before the
+	// writer hooks format the entry
+	log.AddHook(NewExtraFieldHook(service, env))
+	log.AddHook(requestid.Hook{}) // entries logged with a request context carry its id
+
 	log.AddHook(&writer.Hook{ // Send logs with level higher than or equal to warning to stderr
 		Writer: os.Stderr,
 		LogLevels: []log.Level{
@@ -93,7 +99,5 @@ func Init(service, env string) error {
 		})
 	}
 
-	log.AddHook(NewExtraFieldHook(service, env))
-
 	return nil
 }
@@ -0,0 +1,50 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/threecommaio/opc/core"
+	"github.com/threecommaio/opc/core/requestid"
+)
+
+func TestInitLogsRequestID(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %s", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer gin.SetMode(gin.Mode())
+	defer func() {
+		os.Stdout = stdout
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+		log.SetOutput(os.Stderr)
+		log.SetFormatter(&log.TextFormatter{})
+	}()
+
+	if err := Init("api", core.Production); err != nil {
+		t.Fatalf("Failed to init logging: %s", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-123")
+	log.WithContext(ctx).Info("handled")
+	w.Close()
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to read output: %s", err)
+	}
+	var entry map[string]string
+	if err := json.Unmarshal(out, &entry); err != nil {
+		t.Fatalf("Failed to decode %q: %s", out, err)
+	}
+	if entry[requestid.Field] != "req-123" || entry["service"] != "api" || entry["env"] != core.Production {
+		t.Fatalf("Missing fields in %q", out)
+	}
+}
@@ -0,0 +1,414 @@
+// grafana dashboards generated from registered metrics
+package metric
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/K-Phoen/grabana"
+	"github.com/K-Phoen/grabana/dashboard"
+	"github.com/K-Phoen/grabana/row"
+	"github.com/K-Phoen/grabana/target/prometheus"
+	"github.com/K-Phoen/grabana/timeseries"
+	"github.com/K-Phoen/grabana/timeseries/axis"
+	"github.com/K-Phoen/grabana/variable/query"
+	promclient "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/threecommaio/opc/version"
+)
+
+// DefaultDatasource is the grafana prometheus datasource used unless configured
+const DefaultDatasource = "Prometheus"
+
+// errors
+var (
+	ErrNoMetrics = errors.New("no metrics to build a dashboard from")
+)
+
+// Type is the kind of a metric
+type Type string
+
+// metric types
+const (
+	Counter   Type = "counter"
+	Gauge     Type = "gauge"
+	Histogram Type = "histogram"
+	Summary   Type = "summary"
+)
+
+// Definition describes a registered metric
+type Definition struct {
+	// Name is the fully qualified metric name
+	Name string `json:"name"`
+	Help string `json:"help,omitempty"`
+	Type Type   `json:"type"`
+	// Labels are the variable label names
+	Labels []string `json:"labels,omitempty"`
+	// Subsystem groups metrics into a dashboard row, derived from the name
+	// when empty
+	Subsystem string `json:"subsystem,omitempty"`
+}
+
+// ignoredLabels are constant or target labels that aren't worth grouping by
+var ignoredLabels = map[string]bool{
+	"job": true, "instance": true, "service": true, "env": true, "version": true,
+}
+
+// dashboardVariables select the env and service constant labels added by
+// Registry, every query filters by them
+var dashboardVariables = []string{"env", "service"}
+
+// selector is the label matcher of every query, "All" matches any value
+// including metrics without the label
+const selector = `env=~"$env",service=~"$service"`
+
+// rowOrder puts well known subsystems first, others follow alphabetically
+var rowOrder = []string{"http", "webhook", "queue", "db"}
+
+// rowTitles are the row titles of well known subsystems
+var rowTitles = map[string]string{
+	"http":    "HTTP",
+	"webhook": "Webhooks",
+	"queue":   "Queue",
+	"db":      "Database",
+}
+
+// Definitions describes the metrics gathered from g, such as a registry or
+// families parsed from a /metrics endpoint
+func Definitions(g promclient.Gatherer) ([]Definition, error) {
+	families, err := g.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	defs := make([]Definition, 0, len(families))
+	for _, family := range families {
+		def := Definition{Name: family.GetName(), Help: family.GetHelp()}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			def.Type = Counter
+		case dto.MetricType_HISTOGRAM:
+			def.Type = Histogram
+		case dto.MetricType_SUMMARY:
+			def.Type = Summary
+		default:
+			def.Type = Gauge
+		}
+		if len(family.Metric) > 0 {
+			for _, label := range family.Metric[0].GetLabel() {
+				def.Labels = append(def.Labels, label.GetName())
+			}
+		}
+		defs = append(defs, def)
+	}
+
+	return defs, nil
+}
+
+// MergeDefinitions combines definitions by name, the first one of a name wins
+// so registry definitions can be listed before scraped ones
+func MergeDefinitions(sets ...[]Definition) []Definition {
+	seen := make(map[string]bool)
+	var merged []Definition
+	for _, defs := range sets {
+		for _, def := range defs {
+			if seen[def.Name] {
+				continue
+			}
+			seen[def.Name] = true
+			merged = append(merged, def)
+		}
+	}
+
+	return merged
+}
+
+// TextGatherer gathers the metrics in the prometheus text format read from r,
+// such as the body of a /metrics response
+func TextGatherer(r io.Reader) promclient.Gatherer {
+	return promclient.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		var parser expfmt.TextParser
+		parsed, err := parser.TextToMetricFamilies(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse metrics: %w", err)
+		}
+
+		families := make([]*dto.MetricFamily, 0, len(parsed))
+		for _, family := range parsed {
+			families = append(families, family)
+		}
+		sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+
+		return families, nil
+	})
+}
+
+// DashboardConfig configures the generated dashboard
+type DashboardConfig struct {
+	// Title defaults to version.Project
+	Title string
+	// Namespace is stripped from metric names to find their subsystem,
+	// defaults to version.Project
+	Namespace  string
+	Datasource string
+	Tags       []string
+}
+
+// NewDashboard builds a dashboard with a row per subsystem and a panel per
+// metric, counters are graphed as rates and histograms and summaries as
+// quantiles. The env and service variables filter every panel.
+func NewDashboard(cfg DashboardConfig, defs []Definition) (dashboard.Builder, error) {
+	if len(defs) == 0 {
+		return dashboard.Builder{}, ErrNoMetrics
+	}
+	if cfg.Title == "" {
+		cfg.Title = version.Project
+	}
+	if cfg.Namespace == "" {
+		cfg.Namespace = sanitizeName(version.Project)
+	}
+	if cfg.Datasource == "" {
+		cfg.Datasource = DefaultDatasource
+	}
+
+	rows := make(map[string][]Definition)
+	for _, def := range defs {
+		subsystem := def.Subsystem
+		if subsystem == "" {
+			subsystem = subsystemOf(cfg.Namespace, def.Name)
+		}
+		rows[subsystem] = append(rows[subsystem], def)
+	}
+
+	opts := []dashboard.Option{
+		dashboard.AutoRefresh("30s"),
+		dashboard.Time("now-6h", "now"),
+		dashboard.SharedCrossHair(),
+		dashboard.Tags(cfg.Tags),
+	}
+	for _, label := range dashboardVariables {
+		opts = append(opts, dashboard.VariableAsQuery(label,
+			query.DataSource(cfg.Datasource),
+			query.Request(fmt.Sprintf("label_values(%s)", label)),
+			query.Refresh(query.TimeChange),
+			query.Sort(query.AlphabeticalAsc),
+			query.IncludeAll(),
+			query.DefaultAll(),
+			query.AllValue(".*"),
+		))
+	}
+	for _, subsystem := range sortedSubsystems(rows) {
+		defs := rows[subsystem]
+		sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+
+		var panels []row.Option
+		for _, def := range defs {
+			panels = append(panels, panelsFor(cfg.Datasource, def)...)
+		}
+		opts = append(opts, dashboard.Row(rowTitle(subsystem), panels...))
+	}
+
+	return dashboard.New(cfg.Title, opts...), nil
+}
+
+// WriteDashboard writes the dashboard as indented JSON for importing or provisioning
+func WriteDashboard(w io.Writer, builder dashboard.Builder) error {
+	data, err := builder.MarshalIndentJSON()
+	if err != nil {
+		return fmt.Errorf("failed to marshal dashboard: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write dashboard: %w", err)
+	}
+
+	return nil
+}
+
+// GrafanaConfig is the grafana instance dashboards are pushed to
+type GrafanaConfig struct {
+	URL    string
+	Token  string
+	Folder string
+	Client *http.Client
+}
+
+// PushDashboard creates or updates the dashboard in the grafana folder
+func PushDashboard(ctx context.Context, cfg GrafanaConfig, builder dashboard.Builder) error {
+	httpClient := cfg.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	folderName := cfg.Folder
+	if folderName == "" {
+		folderName = version.Project
+	}
+
+	client := grabana.NewClient(httpClient, cfg.URL, grabana.WithAPIToken(cfg.Token))
+	folder, err := client.FindOrCreateFolder(ctx, folderName)
+	if err != nil {
+		return fmt.Errorf("failed to find grafana folder: %w", err)
+	}
+	if _, err := client.UpsertDashboard(ctx, folder, builder); err != nil {
+		return fmt.Errorf("failed to push dashboard: %w", err)
+	}
+
+	return nil
+}
+
+// subsystemOf returns the first word of the name after the namespace
+func subsystemOf(namespace, name string) string {
+	name = strings.TrimPrefix(name, namespace+"_")
+	if i := strings.Index(name, "_"); i > 0 {
+		return name[:i]
+	}
+
+	return name
+}
+
+// sortedSubsystems orders well known subsystems first
+func sortedSubsystems(rows map[string][]Definition) []string {
+	rank := func(subsystem string) int {
+		for i, known := range rowOrder {
+			if known == subsystem {
+				return i
+			}
+		}
+
+		return len(rowOrder)
+	}
+
+	subsystems := make([]string, 0, len(rows))
+	for subsystem := range rows {
+		subsystems = append(subsystems, subsystem)
+	}
+	sort.Slice(subsystems, func(i, j int) bool {
+		ri, rj := rank(subsystems[i]), rank(subsystems[j])
+		if ri != rj {
+			return ri < rj
+		}
+
+		return subsystems[i] < subsystems[j]
+	})
+
+	return subsystems
+}
+
+func rowTitle(subsystem string) string {
+	if title, ok := rowTitles[subsystem]; ok {
+		return title
+	}
+
+	return strings.ToUpper(subsystem[:1]) + subsystem[1:]
+}
+
+// panelsFor returns the panels graphing def
+func panelsFor(datasource string, def Definition) []row.Option {
+	title := def.Help
+	if title == "" {
+		title = def.Name
+	}
+	title = strings.TrimSuffix(title, ".")
+
+	var labels []string
+	for _, label := range def.Labels {
+		if !ignoredLabels[label] {
+			labels = append(labels, label)
+		}
+	}
+	by := strings.Join(labels, ", ")
+	legend := legendFor(labels)
+	common := []timeseries.Option{
+		timeseries.DataSource(datasource),
+		timeseries.Span(6),
+		timeseries.Description(def.Name),
+	}
+
+	switch def.Type {
+	case Counter:
+		expr := fmt.Sprintf("sum(rate(%s{%s}[$__rate_interval]))", def.Name, selector)
+		if by != "" {
+			expr = fmt.Sprintf("sum by (%s) (rate(%s{%s}[$__rate_interval]))", by, def.Name, selector)
+		}
+		panels := []row.Option{row.WithTimeSeries(title, append(common,
+			timeseries.Axis(axis.Unit("ops")),
+			timeseries.WithPrometheusTarget(expr, prometheus.Legend(legend)),
+		)...)}
+		// requests labelled by status also get an error ratio, the E in RED
+		if contains(labels, "status") {
+			panels = append(panels, row.WithTimeSeries(title+" errors", append(common,
+				timeseries.Axis(axis.Unit("percentunit")),
+				timeseries.WithPrometheusTarget(
+					fmt.Sprintf(`sum(rate(%[1]s{status=~"5..",%[2]s}[$__rate_interval])) / sum(rate(%[1]s{%[2]s}[$__rate_interval]))`,
+						def.Name, selector),
+					prometheus.Legend("5xx ratio")),
+			)...))
+		}
+
+		return panels
+	case Histogram:
+		unit := "short"
+		if strings.HasSuffix(def.Name, "_seconds") {
+			unit = "s"
+		}
+		opts := append(common, timeseries.Axis(axis.Unit(unit)))
+		for _, q := range []struct{ quantile, legend string }{{"0.5", "p50"}, {"0.95", "p95"}, {"0.99", "p99"}} {
+			opts = append(opts, timeseries.WithPrometheusTarget(
+				fmt.Sprintf("histogram_quantile(%s, sum by (le) (rate(%s_bucket{%s}[$__rate_interval])))",
+					q.quantile, def.Name, selector),
+				prometheus.Legend(q.legend)))
+		}
+
+		return []row.Option{row.WithTimeSeries(title, opts...)}
+	case Summary:
+		// quantiles computed by each instance can't be summed or averaged,
+		// the worst instance is graphed per quantile
+		unit := "short"
+		if strings.HasSuffix(def.Name, "_seconds") {
+			unit = "s"
+		}
+		quantileBy := strings.Join(append([]string{"quantile"}, labels...), ", ")
+
+		return []row.Option{row.WithTimeSeries(title, append(common,
+			timeseries.Axis(axis.Unit(unit)),
+			timeseries.WithPrometheusTarget(
+				fmt.Sprintf("max by (%s) (%s{%s})", quantileBy, def.Name, selector),
+				prometheus.Legend(strings.TrimSpace("p{{quantile}} "+legend))),
+		)...)}
+	}
+
+	expr := fmt.Sprintf("%s{%s}", def.Name, selector)
+	if by != "" {
+		expr = fmt.Sprintf("sum by (%s) (%s{%s})", by, def.Name, selector)
+	}
+
+	return []row.Option{row.WithTimeSeries(title, append(common,
+		timeseries.WithPrometheusTarget(expr, prometheus.Legend(legend)),
+	)...)}
+}
+
+// legendFor formats the series name from its labels
+func legendFor(labels []string) string {
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = "{{" + label + "}}"
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,185 @@
+package metric
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testDefinitions registers a typical service's metrics on a local registry
+func testDefinitions(t *testing.T) []Definition {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total", Help: "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "http_request_duration_seconds", Help: "HTTP request latency.",
+	}, []string{"route"})
+	validations := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_validations_total", Help: "Webhook signature validations.",
+	}, []string{"provider", "result"})
+	depth := prometheus.NewGauge(prometheus.GaugeOpts{Name: "api_cache_entries", Help: "Cache entries."})
+	upstream := prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "http_upstream_seconds", Help: "Upstream latency.", Objectives: map[float64]float64{0.5: 0.05, 0.99: 0.001},
+	})
+	registry.MustRegister(requests, duration, validations, depth, upstream)
+
+	requests.WithLabelValues("/users/:id", "GET", "200").Inc()
+	duration.WithLabelValues("/users/:id").Observe(0.1)
+	upstream.Observe(0.2)
+	validations.WithLabelValues("github", "verified").Inc()
+
+	defs, err := Definitions(registry)
+	if err != nil {
+		t.Fatalf("Failed to describe metrics: %s", err)
+	}
+
+	return defs
+}
+
+func TestNewDashboard(t *testing.T) {
+	builder, err := NewDashboard(DashboardConfig{Title: "api", Namespace: "api"}, testDefinitions(t))
+	if err != nil {
+		t.Fatalf("Failed to build dashboard: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteDashboard(&buf, builder); err != nil {
+		t.Fatalf("Failed to write dashboard: %s", err)
+	}
+	var board struct {
+		Title      string `json:"title"`
+		Templating struct {
+			List []struct {
+				Name  string `json:"name"`
+				Query string `json:"query"`
+			} `json:"list"`
+		} `json:"templating"`
+		Rows []struct {
+			Title  string `json:"title"`
+			Panels []struct {
+				Targets []struct {
+					Expr string `json:"expr"`
+				} `json:"targets"`
+			} `json:"panels"`
+		} `json:"rows"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &board); err != nil {
+		t.Fatalf("Failed to decode dashboard: %s", err)
+	}
+
+	var titles []string
+	exprs := map[string]bool{}
+	for _, r := range board.Rows {
+		titles = append(titles, r.Title)
+		for _, p := range r.Panels {
+			for _, target := range p.Targets {
+				exprs[target.Expr] = true
+			}
+		}
+	}
+	if strings.Join(titles, ",") != "HTTP,Webhooks,Cache" {
+		t.Fatalf("Unexpected rows: %v", titles)
+	}
+	for _, want := range []string{
+		`sum by (method, route, status) (rate(http_requests_total{env=~"$env",service=~"$service"}[$__rate_interval]))`,
+		`sum(rate(http_requests_total{status=~"5..",env=~"$env",service=~"$service"}[$__rate_interval])) / sum(rate(http_requests_total{env=~"$env",service=~"$service"}[$__rate_interval]))`,
+		`histogram_quantile(0.99, sum by (le) (rate(http_request_duration_seconds_bucket{env=~"$env",service=~"$service"}[$__rate_interval])))`,
+		`max by (quantile) (http_upstream_seconds{env=~"$env",service=~"$service"})`,
+		`sum by (provider, result) (rate(webhook_validations_total{env=~"$env",service=~"$service"}[$__rate_interval]))`,
+		`api_cache_entries{env=~"$env",service=~"$service"}`,
+	} {
+		if !exprs[want] {
+			t.Errorf("Missing query %s in %v", want, exprs)
+		}
+	}
+
+	var variables []string
+	for _, v := range board.Templating.List {
+		variables = append(variables, v.Name+"="+v.Query)
+	}
+	if got := strings.Join(variables, ","); got != "env=label_values(env),service=label_values(service)" {
+		t.Fatalf("Unexpected variables: %s", got)
+	}
+
+	if _, err := NewDashboard(DashboardConfig{}, nil); !errors.Is(err, ErrNoMetrics) {
+		t.Fatalf("Expected no metrics error, got %v", err)
+	}
+}
+
+func TestTextGatherer(t *testing.T) {
+	text := `# HELP jobs_processed_total Jobs processed.
+# TYPE jobs_processed_total counter
+jobs_processed_total{queue="email",service="worker"} 3
+`
+	defs, err := Definitions(TextGatherer(strings.NewReader(text)))
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	if len(defs) != 1 || defs[0].Type != Counter || strings.Join(defs[0].Labels, ",") != "queue,service" {
+		t.Fatalf("Unexpected definitions: %+v", defs)
+	}
+}
+
+func TestMergeDefinitions(t *testing.T) {
+	registered := []Definition{{Name: "jobs_total", Type: Counter, Labels: []string{"queue"}}}
+	scraped := []Definition{
+		{Name: "jobs_total", Type: Counter, Labels: []string{"env", "queue", "service"}},
+		{Name: "http_requests_total", Type: Counter},
+	}
+
+	defs := MergeDefinitions(registered, scraped)
+	if len(defs) != 2 || len(defs[0].Labels) != 1 || defs[1].Name != "http_requests_total" {
+		t.Fatalf("Unexpected definitions: %+v", defs)
+	}
+}
+
+func TestPushDashboard(t *testing.T) {
+	var pushed struct {
+		Dashboard struct {
+			Title string `json:"title"`
+		} `json:"dashboard"`
+		FolderID uint `json:"folderId"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer grafana-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/folders":
+			_, _ = w.Write([]byte(`[{"id":7,"uid":"abc","title":"API"}]`))
+		case r.Method == http.MethodPost && r.URL.Path == "/api/dashboards/db":
+			body, _ := ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &pushed); err != nil {
+				t.Errorf("Failed to decode pushed dashboard: %s", err)
+			}
+			_, _ = w.Write([]byte(`{"id":1,"uid":"dash","url":"/d/dash"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	builder, err := NewDashboard(DashboardConfig{Title: "api"}, testDefinitions(t))
+	if err != nil {
+		t.Fatalf("Failed to build dashboard: %s", err)
+	}
+	if err := PushDashboard(context.Background(), GrafanaConfig{
+		URL: srv.URL, Token: "grafana-token", Folder: "api",
+	}, builder); err != nil {
+		t.Fatalf("Failed to push: %s", err)
+	}
+	if pushed.Dashboard.Title != "api" || pushed.FolderID != 7 {
+		t.Fatalf("Unexpected pushed dashboard: %+v", pushed)
+	}
+}
@@ -1,8 +1,2 @@
 // Package metric provides metrics and visibility functionality
 package metric
-
-import (
-	// force imports.
-	_ "github.com/K-Phoen/grabana"
-	_ "github.com/prometheus/client_golang/prometheus"
-)
@@ -0,0 +1,158 @@
+// push mode for batch jobs and CLIs that exit before being scraped
+package metric
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/threecommaio/opc/version"
+)
+
+// errors
+var (
+	ErrNoPushTarget = errors.New("no pushgateway url or textfile path to flush metrics to")
+)
+
+// PushConfig configures where batch jobs flush their metrics on exit
+type PushConfig struct {
+	// URL of a Pushgateway compatible endpoint
+	URL string
+	// Job and Instance group the pushed metrics, they default to
+	// version.Project and the hostname
+	Job      string
+	Instance string
+	// Grouping adds labels to the grouping key
+	Grouping map[string]string
+	Client   *http.Client
+
+	// TextfilePath is a .prom file for node_exporter's textfile collector
+	TextfilePath string
+	// TextfileFormat defaults to OpenMetrics, use expfmt.FmtText for parsers
+	// without OpenMetrics support
+	TextfileFormat expfmt.Format
+}
+
+// Push replaces the metrics of the job and instance group on the Pushgateway
+func Push(ctx context.Context, g prometheus.Gatherer, cfg PushConfig) error {
+	job := cfg.Job
+	if job == "" {
+		job = version.Project
+	}
+	instance := cfg.Instance
+	if instance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get hostname: %w", err)
+		}
+		instance = hostname
+	}
+
+	pusher := push.New(cfg.URL, job).Gatherer(g).Grouping("instance", instance)
+	for name, value := range cfg.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if err := pusher.Client(contextDoer{ctx: ctx, client: client}).Push(); err != nil {
+		return fmt.Errorf("failed to push metrics: %w", err)
+	}
+
+	return nil
+}
+
+// contextDoer sends the pusher's requests with ctx, which push.Pusher lacks
+type contextDoer struct {
+	ctx    context.Context
+	client *http.Client
+}
+
+// Do implements push.HTTPDoer
+func (d contextDoer) Do(req *http.Request) (*http.Response, error) {
+	return d.client.Do(req.WithContext(d.ctx))
+}
+
+// WriteTextfile writes the metrics to path, the file is replaced atomically
+// so the collector never reads a partial file
+func WriteTextfile(path string, g prometheus.Gatherer, format expfmt.Format) error {
+	if format == "" {
+		format = expfmt.FmtOpenMetrics
+	}
+	families, err := g.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	// the temporary file lacks the .prom suffix so it is ignored by the collector
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create textfile: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	enc := expfmt.NewEncoder(tmp, format)
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to encode metrics: %w", err)
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to encode metrics: %w", err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write textfile: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return fmt.Errorf("failed to write textfile: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write textfile: %w", err)
+	}
+
+	return nil
+}
+
+// Flush pushes the metrics and writes the textfile, whichever are configured,
+// meant to be deferred by jobs
+//
+//	defer func() {
+//		if err := metric.Flush(ctx, reg.Gatherer(), cfg); err != nil {
+//			log.Error(err)
+//		}
+//	}()
+func Flush(ctx context.Context, g prometheus.Gatherer, cfg PushConfig) error {
+	if cfg.URL == "" && cfg.TextfilePath == "" {
+		return ErrNoPushTarget
+	}
+	if cfg.URL != "" {
+		if err := Push(ctx, g, cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.TextfilePath != "" {
+		if err := WriteTextfile(cfg.TextfilePath, g, cfg.TextfileFormat); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Flush flushes the registry's metrics, see Flush
+func (r *Registry) Flush(ctx context.Context, cfg PushConfig) error {
+	return Flush(ctx, r.gatherer, cfg)
+}
@@ -0,0 +1,123 @@
+package metric
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestPush(t *testing.T) {
+	var gotPath, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("Unexpected method: %s", r.Method)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		gotPath, gotBody = r.URL.Path, string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	r, _ := newTestRegistry()
+	jobs, err := r.Counter("jobs_total", "Jobs processed.")
+	if err != nil {
+		t.Fatalf("Failed to register: %s", err)
+	}
+	jobs.WithLabelValues().Inc()
+
+	if err := r.Flush(context.Background(), PushConfig{
+		URL: srv.URL, Job: "nightly", Instance: "runner-1",
+	}); err != nil {
+		t.Fatalf("Failed to push: %s", err)
+	}
+	if gotPath != "/metrics/job/nightly/instance/runner-1" {
+		t.Fatalf("Unexpected grouping: %s", gotPath)
+	}
+	if !strings.Contains(gotBody, "my_project_jobs_total") {
+		t.Fatalf("Pushed metrics missing: %q", gotBody)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("Failed to get hostname: %s", err)
+	}
+	if err := Push(context.Background(), r.Gatherer(), PushConfig{URL: srv.URL}); err != nil {
+		t.Fatalf("Failed to push: %s", err)
+	}
+	if !strings.HasSuffix(gotPath, "/instance/"+hostname) {
+		t.Fatalf("Instance should default to the hostname: %s", gotPath)
+	}
+}
+
+func TestPushError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	r, _ := newTestRegistry()
+	if err := r.Flush(context.Background(), PushConfig{URL: srv.URL, Job: "nightly"}); err == nil {
+		t.Fatal("Expected push to fail")
+	}
+	if err := r.Flush(context.Background(), PushConfig{}); !errors.Is(err, ErrNoPushTarget) {
+		t.Fatalf("Expected no target error, got %v", err)
+	}
+}
+
+func TestWriteTextfile(t *testing.T) {
+	r, _ := newTestRegistry()
+	jobs, err := r.Counter("jobs_total", "Jobs processed.")
+	if err != nil {
+		t.Fatalf("Failed to register: %s", err)
+	}
+	jobs.WithLabelValues().Add(4)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nightly.prom")
+	if err := r.Flush(context.Background(), PushConfig{TextfilePath: path}); err != nil {
+		t.Fatalf("Failed to write textfile: %s", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read textfile: %s", err)
+	}
+	if !strings.Contains(string(data), "# TYPE my_project_jobs counter") || !strings.HasSuffix(string(data), "# EOF\n") {
+		t.Fatalf("Expected OpenMetrics text: %s", data)
+	}
+
+	// parsers without OpenMetrics support get the text format
+	if err := r.Flush(context.Background(), PushConfig{TextfilePath: path, TextfileFormat: expfmt.FmtText}); err != nil {
+		t.Fatalf("Failed to write textfile: %s", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open textfile: %s", err)
+	}
+	defer f.Close()
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(f)
+	if err != nil {
+		t.Fatalf("Failed to parse textfile: %s", err)
+	}
+	family, ok := families["my_project_jobs_total"]
+	if !ok || family.GetType() != dto.MetricType_COUNTER || family.GetMetric()[0].GetCounter().GetValue() != 4 {
+		t.Fatalf("Unexpected metrics: %v", families)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to list dir: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Temporary files were left behind: %d entries", len(entries))
+	}
+}
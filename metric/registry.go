@@ -0,0 +1,218 @@
+// typed registry for declaring service metrics with consistent naming
+package metric
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/threecommaio/opc/version"
+)
+
+// DurationBuckets suit request and job latencies in seconds, from 1ms to a minute
+var DurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// errors
+var (
+	ErrMetricConflict = errors.New("metric already registered with a different type or labels")
+)
+
+// Config configures a Registry
+type Config struct {
+	// Service and Env are attached as constant labels, matching the fields
+	// added to log entries by logging.ExtraFieldHook
+	Service string
+	Env     string
+	// Namespace prefixes every metric, defaults to version.Project
+	Namespace string
+	// Registerer and Gatherer default to the prometheus default registry,
+	// tests should pass a prometheus.NewRegistry
+	Registerer prometheus.Registerer
+	Gatherer   prometheus.Gatherer
+}
+
+// Registry registers metrics namespaced by project with service, env and
+// version constant labels. Registering a metric twice returns the existing
+// collector instead of panicking.
+type Registry struct {
+	namespace   string
+	constLabels prometheus.Labels
+	registerer  prometheus.Registerer
+	gatherer    prometheus.Gatherer
+
+	mu      sync.Mutex
+	metrics map[string]registered
+}
+
+// registered is a collector and the definition it was registered with
+type registered struct {
+	collector prometheus.Collector
+	def       Definition
+}
+
+// NewRegistry creates a registry
+func NewRegistry(cfg Config) *Registry {
+	if cfg.Namespace == "" {
+		cfg.Namespace = version.Project
+	}
+	if cfg.Registerer == nil {
+		cfg.Registerer = prometheus.DefaultRegisterer
+	}
+	if cfg.Gatherer == nil {
+		cfg.Gatherer = prometheus.DefaultGatherer
+	}
+
+	constLabels := prometheus.Labels{"version": version.Version}
+	if cfg.Service != "" {
+		constLabels["service"] = cfg.Service
+	}
+	if cfg.Env != "" {
+		constLabels["env"] = cfg.Env
+	}
+
+	return &Registry{
+		namespace:   sanitizeName(cfg.Namespace),
+		constLabels: constLabels,
+		registerer:  cfg.Registerer,
+		gatherer:    cfg.Gatherer,
+		metrics:     make(map[string]registered),
+	}
+}
+
+// Namespace returns the prefix of the registered metrics
+func (r *Registry) Namespace() string {
+	return r.namespace
+}
+
+// Registerer returns a registerer attaching the constant labels, for collectors
+// created elsewhere such as by web.WithMetrics
+func (r *Registry) Registerer() prometheus.Registerer {
+	return prometheus.WrapRegistererWith(r.constLabels, r.registerer)
+}
+
+// Gatherer returns the underlying prometheus gatherer, for serving or pushing
+func (r *Registry) Gatherer() prometheus.Gatherer {
+	return r.gatherer
+}
+
+// Definitions describes the registered metrics, including ones not observed yet
+func (r *Registry) Definitions() []Definition {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	defs := make([]Definition, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		defs = append(defs, m.def)
+	}
+
+	return defs
+}
+
+// DefinitionsSuffix is appended to the metrics path to serve DefinitionsHandler
+const DefinitionsSuffix = "/definitions"
+
+// DefinitionsHandler serves Definitions as JSON, cmd/dashboard reads it to
+// include metrics that haven't been observed yet and are missing from a scrape
+func (r *Registry) DefinitionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defs := r.Definitions()
+		sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(defs); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// Counter registers a counter such as http_requests_total
+func (r *Registry) Counter(name, help string, labels ...string) (*prometheus.CounterVec, error) {
+	return register(r, Definition{Name: name, Help: help, Type: Counter, Labels: labels}, func(fqName string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: fqName, Help: help, ConstLabels: r.constLabels,
+		}, labels)
+	})
+}
+
+// Gauge registers a gauge such as queue_depth
+func (r *Registry) Gauge(name, help string, labels ...string) (*prometheus.GaugeVec, error) {
+	return register(r, Definition{Name: name, Help: help, Type: Gauge, Labels: labels}, func(fqName string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: fqName, Help: help, ConstLabels: r.constLabels,
+		}, labels)
+	})
+}
+
+// Histogram registers a histogram, buckets default to DurationBuckets
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) (*prometheus.HistogramVec, error) {
+	if buckets == nil {
+		buckets = DurationBuckets
+	}
+	return register(r, Definition{Name: name, Help: help, Type: Histogram, Labels: labels}, func(fqName string) *prometheus.HistogramVec {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: fqName, Help: help, ConstLabels: r.constLabels, Buckets: buckets,
+		}, labels)
+	})
+}
+
+// Timer registers a latency histogram in seconds, the _seconds suffix is
+// added when missing, observe it with Time or TimeFunc
+func (r *Registry) Timer(name, help string, labels ...string) (*prometheus.HistogramVec, error) {
+	if !strings.HasSuffix(name, "_seconds") {
+		name += "_seconds"
+	}
+
+	return r.Histogram(name, help, DurationBuckets, labels...)
+}
+
+// register creates and registers the collector unless a matching one exists
+func register[T prometheus.Collector](r *Registry, def Definition, create func(fqName string) T) (T, error) {
+	var zero T
+	def.Name = prometheus.BuildFQName(r.namespace, "", def.Name)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.metrics[def.Name]; ok {
+		c, ok := existing.collector.(T)
+		if !ok || existing.def.Type != def.Type || strings.Join(existing.def.Labels, ",") != strings.Join(def.Labels, ",") {
+			return zero, fmt.Errorf("%w: %s", ErrMetricConflict, def.Name)
+		}
+
+		return c, nil
+	}
+
+	c := create(def.Name)
+	if err := r.registerer.Register(c); err != nil {
+		// registered by another Registry sharing the registerer
+		var are prometheus.AlreadyRegisteredError
+		if !errors.As(err, &are) {
+			return zero, fmt.Errorf("failed to register %s: %w", def.Name, err)
+		}
+		existing, ok := are.ExistingCollector.(T)
+		if !ok {
+			return zero, fmt.Errorf("%w: %s", ErrMetricConflict, def.Name)
+		}
+		c = existing
+	}
+	r.metrics[def.Name] = registered{collector: c, def: def}
+
+	return c, nil
+}
+
+// sanitizeName replaces characters not allowed in metric names, such as the
+// dashes of a project name
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+
+		return '_'
+	}, name)
+}
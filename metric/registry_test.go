@@ -0,0 +1,150 @@
+package metric
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/threecommaio/opc/version"
+)
+
+func newTestRegistry() (*Registry, *prometheus.Registry) {
+	local := prometheus.NewRegistry()
+
+	return NewRegistry(Config{
+		Service:    "api",
+		Env:        "test",
+		Namespace:  "my-project",
+		Registerer: local,
+		Gatherer:   local,
+	}), local
+}
+
+func TestRegistry(t *testing.T) {
+	r, local := newTestRegistry()
+
+	jobs, err := r.Counter("jobs_total", "Jobs processed.", "queue")
+	if err != nil {
+		t.Fatalf("Failed to register: %s", err)
+	}
+	jobs.WithLabelValues("email").Add(2)
+
+	again, err := r.Counter("jobs_total", "Jobs processed.", "queue")
+	if err != nil {
+		t.Fatalf("Registering twice should return the existing counter: %s", err)
+	}
+	again.WithLabelValues("email").Inc()
+
+	want := `
+# HELP my_project_jobs_total Jobs processed.
+# TYPE my_project_jobs_total counter
+my_project_jobs_total{env="test",queue="email",service="api",version="` + version.Version + `"} 3
+`
+	if err := testutil.GatherAndCompare(local, strings.NewReader(want), "my_project_jobs_total"); err != nil {
+		t.Fatalf("Unexpected metrics: %s", err)
+	}
+
+	if _, err := r.Gauge("jobs_total", "Jobs processed.", "queue"); !errors.Is(err, ErrMetricConflict) {
+		t.Fatalf("Expected a type conflict, got %v", err)
+	}
+	if _, err := r.Counter("jobs_total", "Jobs processed.", "status"); !errors.Is(err, ErrMetricConflict) {
+		t.Fatalf("Expected a label conflict, got %v", err)
+	}
+
+	// a second registry sharing the prometheus registry reuses the collector
+	other := NewRegistry(Config{Service: "api", Env: "test", Namespace: "my-project", Registerer: local, Gatherer: local})
+	if _, err := other.Counter("jobs_total", "Jobs processed.", "queue"); err != nil {
+		t.Fatalf("Failed to share collector: %s", err)
+	}
+	if _, err := other.Gauge("jobs_total", "Jobs processed.", "queue"); !errors.Is(err, ErrMetricConflict) {
+		t.Fatalf("Expected a type conflict, got %v", err)
+	}
+}
+
+func TestTimer(t *testing.T) {
+	r, local := newTestRegistry()
+
+	latency, err := r.Timer("sync", "Sync duration.", "source")
+	if err != nil {
+		t.Fatalf("Failed to register: %s", err)
+	}
+	errSync := errors.New("sync failed")
+	if err := TimeFunc(latency.WithLabelValues("github"), func() error { return errSync }); !errors.Is(err, errSync) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	func() {
+		defer Time(latency.WithLabelValues("github"))()
+	}()
+
+	families, err := local.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather: %s", err)
+	}
+	if len(families) != 1 || families[0].GetName() != "my_project_sync_seconds" {
+		t.Fatalf("Unexpected families: %v", families)
+	}
+	if n := families[0].Metric[0].GetHistogram().GetSampleCount(); n != 2 {
+		t.Fatalf("Unexpected sample count: %d", n)
+	}
+}
+
+func TestRegistryDefinitions(t *testing.T) {
+	r, local := newTestRegistry()
+	if _, err := r.Gauge("queue_depth", "Queued deliveries.", "queue"); err != nil {
+		t.Fatalf("Failed to register: %s", err)
+	}
+
+	defs := r.Definitions()
+	if len(defs) != 1 || defs[0].Name != "my_project_queue_depth" || defs[0].Type != Gauge {
+		t.Fatalf("Unexpected definitions: %+v", defs)
+	}
+	builder, err := NewDashboard(DashboardConfig{Namespace: r.Namespace()}, defs)
+	if err != nil {
+		t.Fatalf("Failed to build dashboard: %s", err)
+	}
+	if rows := builder.Internal().Rows; len(rows) != 1 || rows[0].Title != "Queue" {
+		t.Fatalf("Unexpected rows: %+v", rows)
+	}
+
+	// collectors created elsewhere get the constant labels too
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "external_total", Help: "External."})
+	if err := r.Registerer().Register(c); err != nil {
+		t.Fatalf("Failed to register: %s", err)
+	}
+	c.Inc()
+	want := `
+# HELP external_total External.
+# TYPE external_total counter
+external_total{env="test",service="api",version="` + version.Version + `"} 1
+`
+	if err := testutil.GatherAndCompare(local, strings.NewReader(want), "external_total"); err != nil {
+		t.Fatalf("Unexpected metrics: %s", err)
+	}
+}
+
+func TestRegistryDefinitionsHandler(t *testing.T) {
+	r, _ := newTestRegistry()
+	// never observed, so a scrape wouldn't show it
+	if _, err := r.Counter("jobs_total", "Jobs processed.", "queue"); err != nil {
+		t.Fatalf("Failed to register: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.DefinitionsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics"+DefinitionsSuffix, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: %d", w.Code)
+	}
+	var defs []Definition
+	if err := json.Unmarshal(w.Body.Bytes(), &defs); err != nil {
+		t.Fatalf("Failed to decode: %s", err)
+	}
+	if len(defs) != 1 || defs[0].Name != "my_project_jobs_total" || defs[0].Type != Counter {
+		t.Fatalf("Unexpected definitions: %+v", defs)
+	}
+}
@@ -0,0 +1,26 @@
+// timing helpers for latency histograms
+package metric
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Time starts a timer observing the elapsed seconds when the returned func is called
+//
+//	defer metric.Time(latency.WithLabelValues("sync"))()
+func Time(o prometheus.Observer) func() {
+	start := time.Now()
+
+	return func() {
+		o.Observe(time.Since(start).Seconds())
+	}
+}
+
+// TimeFunc runs fn and observes its duration in seconds
+func TimeFunc(o prometheus.Observer, fn func() error) error {
+	defer Time(o)()
+
+	return fn()
+}
@@ -0,0 +1,108 @@
+// bearer token authentication
+package web
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/threecommaio/opc/core/oidc"
+)
+
+// ContextKeyClaims is the gin context key holding the verified *oidc.Claims
+const ContextKeyClaims = "auth.claims"
+
+// errors
+var (
+	ErrMissingBearer = errors.New("missing bearer token")
+	ErrNoVerifier    = errors.New("bearer auth needs a verifier")
+)
+
+// BearerConfig configures BearerAuth
+type BearerConfig struct {
+	// Verifier checks the token, see oidc.NewVerifier and oidc.GoogleVerifier
+	Verifier *oidc.Verifier
+	// AllowEmails restricts access to verified emails such as a service
+	// account, oidc.GoogleIDToken includes the email. Tokens without one, such
+	// as github actions tokens, must be allowed by subject.
+	AllowEmails []string
+	// AllowSubjects restricts access by sub, such as repo:org/repo:ref:refs/heads/main
+	AllowSubjects []string
+}
+
+// BearerAuth verifies the bearer JWT in the Authorization header and stores
+// its claims on the gin context, when both allowlists are set either may match.
+// Invalid tokens are a 401, a key set that can't be fetched is a 503.
+func BearerAuth(cfg BearerConfig) (gin.HandlerFunc, error) {
+	if cfg.Verifier == nil {
+		return nil, ErrNoVerifier
+	}
+	emails := make(map[string]bool, len(cfg.AllowEmails))
+	for _, email := range cfg.AllowEmails {
+		emails[strings.ToLower(email)] = true
+	}
+	subjects := make(map[string]bool, len(cfg.AllowSubjects))
+	for _, sub := range cfg.AllowSubjects {
+		subjects[sub] = true
+	}
+
+	return func(c *gin.Context) {
+		token, ok := bearerToken(c.GetHeader("Authorization"))
+		if !ok {
+			c.Header("WWW-Authenticate", `Bearer`)
+			Abort(c, fmt.Errorf("%w: %s", ErrUnauthorized, ErrMissingBearer))
+			return
+		}
+
+		claims, err := cfg.Verifier.Verify(c.Request.Context(), token)
+		switch {
+		case errors.Is(err, oidc.ErrKeySetUnavailable):
+			// an identity provider outage isn't the client's fault
+			Abort(c, NewHTTPError(http.StatusServiceUnavailable, err))
+			return
+		case err != nil && c.Request.Context().Err() != nil:
+			Abort(c, err)
+			return
+		case err != nil:
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			Abort(c, fmt.Errorf("%w: %s", ErrUnauthorized, err))
+			return
+		}
+
+		if len(emails) > 0 || len(subjects) > 0 {
+			allowed := subjects[claims.Subject] ||
+				(claims.EmailVerified && emails[strings.ToLower(claims.Email)])
+			if !allowed {
+				Abort(c, fmt.Errorf("%w: %q is not allowed", ErrForbidden, claims.Subject))
+				return
+			}
+		}
+
+		c.Set(ContextKeyClaims, claims)
+		c.Next()
+	}, nil
+}
+
+// bearerToken extracts the token from an Authorization header
+func bearerToken(header string) (string, bool) {
+	const prefix = "bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	token := strings.TrimSpace(header[len(prefix):])
+
+	return token, token != ""
+}
+
+// ClaimsFrom returns the claims verified by BearerAuth
+func ClaimsFrom(c *gin.Context) (*oidc.Claims, bool) {
+	v, ok := c.Get(ContextKeyClaims)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := v.(*oidc.Claims)
+
+	return claims, ok
+}
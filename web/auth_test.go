@@ -0,0 +1,166 @@
+package web
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/threecommaio/opc/core/oidc"
+)
+
+// signTestJWT creates a RS256 token
+func signTestJWT(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	enc := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := enc(header) + "." + enc(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign: %s", err)
+	}
+
+	return signed + "." + enc(signature)
+}
+
+func TestBearerAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := base64.RawURLEncoding.EncodeToString
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "test", "n": enc(key.N.Bytes()), "e": enc(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer jwks.Close()
+
+	verifier, err := oidc.NewVerifier(oidc.VerifierConfig{
+		JWKSURL: jwks.URL, Issuers: []string{oidc.GoogleIssuer}, Audiences: []string{"https://api.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %s", err)
+	}
+	auth, err := BearerAuth(BearerConfig{
+		Verifier:      verifier,
+		AllowEmails:   []string{"deployer@my-project.iam.gserviceaccount.com"},
+		AllowSubjects: []string{"repo:threecommaio/opc:ref:refs/heads/main"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create bearer auth: %s", err)
+	}
+	router := gin.New()
+	router.GET("/private", auth, func(c *gin.Context) {
+		claims, _ := ClaimsFrom(c)
+		c.String(http.StatusOK, claims.Subject)
+	})
+
+	token := func(sub, email string, verified bool) string {
+		return signTestJWT(t, key, map[string]interface{}{
+			"iss": oidc.GoogleIssuer, "aud": "https://api.example.com", "sub": sub,
+			"email": email, "email_verified": verified, "exp": time.Now().Add(time.Hour).Unix(),
+		})
+	}
+	// generateIdToken with includeEmail, without it there are no email claims
+	now := time.Now()
+	serviceAccountToken := signTestJWT(t, key, map[string]interface{}{
+		"aud": "https://api.example.com", "azp": "106613492311208931234",
+		"email": "deployer@my-project.iam.gserviceaccount.com", "email_verified": true,
+		"exp": now.Add(time.Hour).Unix(), "iat": now.Unix(),
+		"iss": oidc.GoogleIssuer, "sub": "106613492311208931234",
+	})
+	withoutEmail := signTestJWT(t, key, map[string]interface{}{
+		"aud": "https://api.example.com", "azp": "106613492311208931234",
+		"exp": now.Add(time.Hour).Unix(), "iat": now.Unix(),
+		"iss": oidc.GoogleIssuer, "sub": "106613492311208931234",
+	})
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"not bearer", "Basic dXNlcjpwYXNz", http.StatusUnauthorized},
+		{"invalid", "Bearer not-a-token", http.StatusUnauthorized},
+		{"allowed email", "Bearer " + token("1", "deployer@my-project.iam.gserviceaccount.com", true), http.StatusOK},
+		{"unverified email", "Bearer " + token("1", "deployer@my-project.iam.gserviceaccount.com", false), http.StatusForbidden},
+		{"allowed subject", "bearer " + token("repo:threecommaio/opc:ref:refs/heads/main", "", false), http.StatusOK},
+		{"not allowed", "Bearer " + token("2", "other@my-project.iam.gserviceaccount.com", true), http.StatusForbidden},
+		{"service account", "Bearer " + serviceAccountToken, http.StatusOK},
+		{"service account without email", "Bearer " + withoutEmail, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/private", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("Unexpected status: got %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Fatalf("Missing WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestBearerAuthNeedsVerifier(t *testing.T) {
+	if _, err := BearerAuth(BearerConfig{}); !errors.Is(err, ErrNoVerifier) {
+		t.Fatalf("Expected no verifier error, got %v", err)
+	}
+}
+
+func TestBearerAuthKeySetUnavailable(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer jwks.Close()
+
+	verifier, err := oidc.NewVerifier(oidc.VerifierConfig{
+		JWKSURL: jwks.URL, Issuers: []string{oidc.GoogleIssuer}, Audiences: []string{"https://api.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %s", err)
+	}
+	auth, err := BearerAuth(BearerConfig{Verifier: verifier})
+	if err != nil {
+		t.Fatalf("Failed to create bearer auth: %s", err)
+	}
+	router := gin.New()
+	router.GET("/private", auth, func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	token := signTestJWT(t, key, map[string]interface{}{
+		"iss": oidc.GoogleIssuer, "aud": "https://api.example.com", "sub": "1", "exp": time.Now().Add(time.Hour).Unix(),
+	})
+	// the second request is inside the refresh rate limit
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/private", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("WWW-Authenticate") != "" {
+			t.Fatalf("Unexpected response %d: %d %v", i, w.Code, w.Header())
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// structured error responses for handlers
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/threecommaio/opc/core"
+)
+
+const (
+	// MIMEProblemJSON is the RFC 7807 problem details media type
+	MIMEProblemJSON = "application/problem+json"
+
+	// ContextKeyProblemJSON makes Abort respond with problem details when set
+	ContextKeyProblemJSON = "web.problem_json"
+
+	// ContextKeyErrorDetails makes Abort return the full error when set
+	ContextKeyErrorDetails = "web.error_details"
+)
+
+// errors mapped to statuses by Abort, wrap them to add context
+var (
+	ErrValidation   = errors.New("validation failed")
+	ErrNotFound     = errors.New("not found")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrConflict     = errors.New("conflict")
+	ErrRateLimited  = errors.New("rate limited")
+)
+
+// errorStatuses maps wrapped errors to their status, the first match wins
+var errorStatuses = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{ErrValidation, http.StatusBadRequest, "validation_failed"},
+	{ErrNotFound, http.StatusNotFound, "not_found"},
+	{ErrUnauthorized, http.StatusUnauthorized, "unauthorized"},
+	{ErrForbidden, http.StatusForbidden, "forbidden"},
+	{ErrConflict, http.StatusConflict, "conflict"},
+	{ErrReplayedDelivery, http.StatusConflict, "replayed_delivery"},
+	{ErrRateLimited, http.StatusTooManyRequests, "rate_limited"},
+	{ErrBodyTooLarge, http.StatusRequestEntityTooLarge, "body_too_large"},
+	{context.DeadlineExceeded, http.StatusGatewayTimeout, "timeout"},
+}
+
+// statusCodes are the codes of errors created from a status
+var statusCodes = map[int]string{
+	http.StatusBadRequest:          "bad_request",
+	http.StatusUnauthorized:        "unauthorized",
+	http.StatusForbidden:           "forbidden",
+	http.StatusNotFound:            "not_found",
+	http.StatusConflict:            "conflict",
+	http.StatusTooManyRequests:     "rate_limited",
+	http.StatusInternalServerError: "internal_error",
+	http.StatusServiceUnavailable:  "unavailable",
+}
+
+// HTTPError is an error with the response it should produce. Message and Code
+// are returned to clients, Cause is logged and only returned in development or
+// with WithErrorDetails.
+type HTTPError struct {
+	Status  int
+	Code    string
+	Message string
+	Cause   error
+}
+
+// NewHTTPError creates an error for status with the status text as message
+func NewHTTPError(status int, cause error) *HTTPError {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	}
+
+	return &HTTPError{Status: status, Code: code, Message: http.StatusText(status), Cause: cause}
+}
+
+// Error implements error
+func (e *HTTPError) Error() string {
+	if e.Cause == nil {
+		return e.Message
+	}
+
+	return e.Message + ": " + e.Cause.Error()
+}
+
+// Unwrap returns the cause
+func (e *HTTPError) Unwrap() error {
+	return e.Cause
+}
+
+// problem is an RFC 7807 problem details body
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code,omitempty"`
+}
+
+// Abort logs err and aborts with the status it maps to, an HTTPError anywhere
+// in the chain is used as is, unknown errors are a 500
+func Abort(c *gin.Context, err error) {
+	httpErr := asHTTPError(err)
+
+	entry := Log(c).WithError(err).WithField("status", httpErr.Status)
+	if httpErr.Status >= http.StatusInternalServerError {
+		entry.Error("request failed")
+	} else {
+		entry.Warn("request failed")
+	}
+
+	message := httpErr.Message
+	if core.Environment() == core.Development || c.GetBool(ContextKeyErrorDetails) {
+		message = err.Error()
+	}
+
+	if c.GetBool(ContextKeyProblemJSON) || strings.Contains(c.GetHeader("Accept"), MIMEProblemJSON) {
+		c.Abort()
+		c.Render(httpErr.Status, problemRender{problem{
+			Type:     "about:blank",
+			Title:    http.StatusText(httpErr.Status),
+			Status:   httpErr.Status,
+			Detail:   message,
+			Instance: c.Request.URL.Path,
+			Code:     httpErr.Code,
+		}})
+
+		return
+	}
+
+	c.AbortWithStatusJSON(httpErr.Status,
+		gin.H{"status": false, "message": message, "code": httpErr.Code})
+}
+
+// asHTTPError finds the HTTPError for err
+func asHTTPError(err error) *HTTPError {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr
+	}
+	for _, mapping := range errorStatuses {
+		if errors.Is(err, mapping.err) {
+			return &HTTPError{
+				Status:  mapping.status,
+				Code:    mapping.code,
+				Message: mapping.err.Error(),
+				Cause:   err,
+			}
+		}
+	}
+	httpErr = NewHTTPError(http.StatusInternalServerError, err)
+	httpErr.Message = "internal server error"
+
+	return httpErr
+}
+
+// WithProblemJSON responds with RFC 7807 problem details from Abort for every
+// route, clients can also ask for them with the Accept header
+func WithProblemJSON() Option {
+	return func(s *Srv) {
+		s.router.Use(func(c *gin.Context) {
+			c.Set(ContextKeyProblemJSON, true)
+		})
+	}
+}
+
+// WithErrorDetails returns the full error chain from Abort outside development,
+// it can leak internals so only use it for services that aren't public
+func WithErrorDetails() Option {
+	return func(s *Srv) {
+		s.router.Use(func(c *gin.Context) {
+			c.Set(ContextKeyErrorDetails, true)
+		})
+	}
+}
+
+// problemRender writes problem details with the problem+json content type
+type problemRender struct {
+	problem problem
+}
+
+// Render implements render.Render
+func (r problemRender) Render(w http.ResponseWriter) error {
+	r.WriteContentType(w)
+
+	return json.NewEncoder(w).Encode(r.problem)
+}
+
+// WriteContentType implements render.Render
+func (r problemRender) WriteContentType(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", MIMEProblemJSON)
+}
@@ -0,0 +1,111 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAbort(t *testing.T) {
+	errDB := errors.New("pq: connection refused to 10.0.0.3")
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"not found", fmt.Errorf("user 7: %w", ErrNotFound), http.StatusNotFound, "not_found"},
+		{"validation", fmt.Errorf("email: %w", ErrValidation), http.StatusBadRequest, "validation_failed"},
+		{"unauthorized", ErrUnauthorized, http.StatusUnauthorized, "unauthorized"},
+		{"conflict", fmt.Errorf("slug taken: %w", ErrConflict), http.StatusConflict, "conflict"},
+		{"rate limited", ErrRateLimited, http.StatusTooManyRequests, "rate_limited"},
+		{"replayed", fmt.Errorf("%w: abc", ErrReplayedDelivery), http.StatusConflict, "replayed_delivery"},
+		{"http error", fmt.Errorf("wrapped: %w", &HTTPError{
+			Status: http.StatusPaymentRequired, Code: "plan_limit", Message: "upgrade your plan", Cause: errDB,
+		}), http.StatusPaymentRequired, "plan_limit"},
+		{"unknown", errDB, http.StatusInternalServerError, "internal_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/users/7", nil)
+			Abort(c, tt.err)
+
+			var body struct {
+				Status  bool   `json:"status"`
+				Message string `json:"message"`
+				Code    string `json:"code"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("Failed to decode: %s", err)
+			}
+			if w.Code != tt.status || body.Code != tt.code || !c.IsAborted() {
+				t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAbortHidesDetailsOutsideDevelopment(t *testing.T) {
+	defer gin.SetMode(gin.Mode())
+	errDB := errors.New("pq: password authentication failed for user admin")
+	hidden := `{"code":"internal_error","message":"internal server error","status":false}`
+	shown := `{"code":"internal_error","message":"pq: password authentication failed for user admin","status":false}`
+
+	for _, tt := range []struct {
+		mode    string
+		details bool
+		want    string
+	}{
+		{gin.ReleaseMode, false, hidden},
+		{gin.TestMode, false, hidden},
+		{gin.DebugMode, false, shown},
+		{gin.ReleaseMode, true, shown},
+	} {
+		gin.SetMode(tt.mode)
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.details {
+			c.Set(ContextKeyErrorDetails, true)
+		}
+		IsError(c, errDB)
+
+		if w.Code != http.StatusInternalServerError || w.Body.String() != tt.want {
+			t.Fatalf("Unexpected response in %s mode: %d %s", tt.mode, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestProblemJSON(t *testing.T) {
+	_, router, err := New(SrvConfig{ReadTimeout: "10s", WriteTimeout: "10s"}, WithProblemJSON())
+	if err != nil {
+		t.Fatalf("Server setup failed: %s", err)
+	}
+	router.GET("/users/:id", func(c *gin.Context) {
+		Abort(c, fmt.Errorf("user %s: %w", c.Param("id"), ErrNotFound))
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/7", nil))
+	if ct := w.Header().Get("Content-Type"); ct != MIMEProblemJSON {
+		t.Fatalf("Unexpected content type: %s", ct)
+	}
+	var p problem
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("Failed to decode: %s", err)
+	}
+	want := problem{
+		Type: "about:blank", Title: "Not Found", Status: http.StatusNotFound,
+		Detail: "user 7: not found", Instance: "/users/7", Code: "not_found",
+	}
+	if w.Code != http.StatusNotFound || p != want {
+		t.Fatalf("Unexpected problem: %d %+v", w.Code, p)
+	}
+}
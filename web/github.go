@@ -0,0 +1,115 @@
+// github webhook event routing
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-github/v43/github"
+)
+
+const (
+	HeaderGithubEvent = "X-GitHub-Event"
+
+	// ContextKeyGithubEvent is the gin context key holding the parsed github event
+	ContextKeyGithubEvent = "github.event"
+)
+
+// errors
+var (
+	ErrGithubEventType = errors.New("unexpected github event type")
+)
+
+// GithubHandler handles a github event parsed by github.ParseWebHook, such as
+// *github.PullRequestEvent
+type GithubHandler func(c *gin.Context, event interface{})
+
+// GithubRouter dispatches github webhooks to handlers registered per event
+// type and action. Place it after WebhookSecretValidation, both share the raw
+// body through RawBody so it is read once.
+type GithubRouter struct {
+	mu       sync.RWMutex
+	handlers map[string]GithubHandler
+}
+
+// NewGithubRouter creates an empty github router
+func NewGithubRouter() *GithubRouter {
+	return &GithubRouter{handlers: make(map[string]GithubHandler)}
+}
+
+// Handle registers a handler for an event such as "push", or an event and
+// action such as "pull_request.opened", the action takes precedence
+func (r *GithubRouter) Handle(eventAction string, h GithubHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[eventAction] = h
+}
+
+// HandleGithub registers a typed handler, for example
+//
+//	HandleGithub(r, "pull_request.opened", func(c *gin.Context, e *github.PullRequestEvent) {})
+func HandleGithub[T any](r *GithubRouter, eventAction string, h func(c *gin.Context, event T)) {
+	r.Handle(eventAction, func(c *gin.Context, event interface{}) {
+		e, ok := event.(T)
+		if !ok {
+			IsError(c, fmt.Errorf("%w: %T", ErrGithubEventType, event))
+			return
+		}
+		h(c, e)
+	})
+}
+
+// Handler parses the webhook and dispatches it, ping is answered and events
+// without a handler are accepted with 202
+func (r *GithubRouter) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		data, err := RawBody(c)
+		if IsError(c, err) {
+			return
+		}
+
+		eventType := github.WebHookType(c.Request)
+		if eventType == "ping" {
+			c.JSON(http.StatusOK, gin.H{"status": true, "message": "pong"})
+			return
+		}
+
+		event, err := github.ParseWebHook(eventType, data)
+		if err != nil {
+			Abort(c, NewHTTPError(http.StatusBadRequest, err))
+			return
+		}
+		c.Set(ContextKeyGithubEvent, event)
+
+		var payload struct {
+			Action string `json:"action"`
+		}
+		_ = json.Unmarshal(data, &payload)
+
+		h, ok := r.handler(eventType, payload.Action)
+		if !ok {
+			c.Status(http.StatusAccepted)
+			return
+		}
+		h(c, event)
+	}
+}
+
+// handler finds the handler for the event and action
+func (r *GithubRouter) handler(eventType, action string) (GithubHandler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if action != "" {
+		if h, ok := r.handlers[eventType+"."+action]; ok {
+			return h, true
+		}
+	}
+	h, ok := r.handlers[eventType]
+
+	return h, ok
+}
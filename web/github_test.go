@@ -0,0 +1,66 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-github/v43/github"
+
+	"github.com/threecommaio/opc/core/hmac"
+)
+
+func TestGithubRouter(t *testing.T) {
+	const secret = "github-secret"
+	gr := NewGithubRouter()
+	HandleGithub(gr, "pull_request.opened", func(c *gin.Context, e *github.PullRequestEvent) {
+		c.String(http.StatusOK, "opened %d", e.GetNumber())
+	})
+	HandleGithub(gr, "pull_request", func(c *gin.Context, e *github.PullRequestEvent) {
+		c.String(http.StatusOK, "pull request %s", e.GetAction())
+	})
+	HandleGithub(gr, "push", func(c *gin.Context, e *github.PullRequestEvent) {
+		c.String(http.StatusOK, "wrong type")
+	})
+
+	router := gin.New()
+	router.POST("/github", WebhookSecretValidation(Signature{
+		Name: "github", Header: HeaderGithub, Secret: StaticSecret(secret), IsValid: GithubValidator,
+	}), gr.Handler())
+
+	tests := []struct {
+		name   string
+		event  string
+		body   string
+		status int
+		want   string
+	}{
+		{"action", "pull_request", `{"action":"opened","number":7}`, http.StatusOK, "opened 7"},
+		{"event fallback", "pull_request", `{"action":"closed","number":7}`, http.StatusOK, "pull request closed"},
+		{"ping", "ping", `{"zen":"Keep it logically awesome."}`, http.StatusOK, `{"message":"pong","status":true}`},
+		{"unhandled", "issues", `{"action":"opened"}`, http.StatusAccepted, ""},
+		{"handler type mismatch", "push", `{"ref":"refs/heads/main"}`, http.StatusInternalServerError, ""},
+		{"unknown event", "not_an_event", `{}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature, err := hmac.Sign(hmac.Github, []byte(tt.body), []byte(secret))
+			if err != nil {
+				t.Fatalf("Failed to sign: %s", err)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/github", strings.NewReader(tt.body))
+			req.Header.Set(HeaderGithubEvent, tt.event)
+			req.Header.Set(HeaderGithub, signature)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("Unexpected status: got %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.want != "" && w.Body.String() != tt.want {
+				t.Fatalf("Unexpected response: got %q, want %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
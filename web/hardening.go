@@ -0,0 +1,241 @@
+// cors, security headers, body size limits and trusted proxies
+package web
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultBodyLimit is the production body size limit, github caps webhook
+// payloads at 25MB
+const DefaultBodyLimit = 25 * humanize.MiByte
+
+// errors
+var (
+	ErrBodyTooLarge            = errors.New("request body too large")
+	ErrCORSWildcardCredentials = errors.New("cors credentials can't be allowed for any origin")
+)
+
+// CORSConfig is the cross origin policy, requests from other origins are
+// refused by browsers unless allowed here
+type CORSConfig struct {
+	// AllowOrigins such as https://app.example.com, "*" allows any origin
+	AllowOrigins []string
+	// AllowMethods defaults to GET, POST, PUT, PATCH, DELETE and HEAD
+	AllowMethods []string
+	// AllowHeaders defaults to Content-Type, Authorization and X-Request-ID
+	AllowHeaders     []string
+	ExposeHeaders    []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// WithCORS answers preflight requests and sets the CORS headers for allowed origins
+func WithCORS(cfg CORSConfig) Option {
+	return func(s *Srv) {
+		anyOrigin := false
+		origins := make(map[string]bool, len(cfg.AllowOrigins))
+		for _, origin := range cfg.AllowOrigins {
+			if origin == "*" {
+				anyOrigin = true
+			}
+			origins[strings.ToLower(origin)] = true
+		}
+		if anyOrigin && cfg.AllowCredentials {
+			s.err = ErrCORSWildcardCredentials
+			return
+		}
+		if cfg.AllowMethods == nil {
+			cfg.AllowMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut,
+				http.MethodPatch, http.MethodDelete, http.MethodHead}
+		}
+		if cfg.AllowHeaders == nil {
+			cfg.AllowHeaders = []string{"Content-Type", "Authorization", HeaderRequestID}
+		}
+		methods := strings.Join(cfg.AllowMethods, ", ")
+		headers := strings.Join(cfg.AllowHeaders, ", ")
+		expose := strings.Join(cfg.ExposeHeaders, ", ")
+		maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+		s.router.Use(func(c *gin.Context) {
+			origin := c.GetHeader("Origin")
+			if origin == "" {
+				c.Next()
+				return
+			}
+			c.Writer.Header().Add("Vary", "Origin")
+			preflight := c.Request.Method == http.MethodOptions &&
+				c.GetHeader("Access-Control-Request-Method") != ""
+
+			if !anyOrigin && !origins[strings.ToLower(origin)] {
+				if preflight {
+					c.AbortWithStatus(http.StatusForbidden)
+					return
+				}
+				c.Next()
+				return
+			}
+
+			if anyOrigin {
+				c.Header("Access-Control-Allow-Origin", "*")
+			} else {
+				c.Header("Access-Control-Allow-Origin", origin)
+			}
+			if cfg.AllowCredentials {
+				c.Header("Access-Control-Allow-Credentials", "true")
+			}
+			if expose != "" {
+				c.Header("Access-Control-Expose-Headers", expose)
+			}
+			if preflight {
+				c.Header("Access-Control-Allow-Methods", methods)
+				c.Header("Access-Control-Allow-Headers", headers)
+				if cfg.MaxAge > 0 {
+					c.Header("Access-Control-Max-Age", maxAge)
+				}
+				c.AbortWithStatus(http.StatusNoContent)
+				return
+			}
+			c.Next()
+		})
+	}
+}
+
+// SecurityHeaders are set on every response, empty values are not sent
+type SecurityHeaders struct {
+	// HSTSMaxAge enables Strict-Transport-Security on https requests
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	ContentSecurityPolicy string
+	FrameOptions          string
+	ReferrerPolicy        string
+	NoSniff               bool
+}
+
+// DefaultSecurityHeaders are the production security headers
+func DefaultSecurityHeaders() SecurityHeaders {
+	return SecurityHeaders{
+		HSTSMaxAge:            365 * 24 * time.Hour,
+		ContentSecurityPolicy: "default-src 'self'; object-src 'none'; base-uri 'self'; frame-ancestors 'none'",
+		FrameOptions:          "DENY",
+		ReferrerPolicy:        "strict-origin-when-cross-origin",
+		NoSniff:               true,
+	}
+}
+
+// WithSecurityHeaders sets the security headers, replacing the production
+// defaults, pass SecurityHeaders{} to send none
+func WithSecurityHeaders(h SecurityHeaders) Option {
+	return func(s *Srv) {
+		s.securityHeaders = &h
+	}
+}
+
+// securityHeaders is the middleware setting h
+func securityHeaders(h SecurityHeaders) gin.HandlerFunc {
+	hsts := ""
+	if h.HSTSMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", int(h.HSTSMaxAge.Seconds()))
+		if h.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+
+	return func(c *gin.Context) {
+		// browsers ignore hsts over plain http
+		if hsts != "" && (c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https") {
+			c.Header("Strict-Transport-Security", hsts)
+		}
+		if h.ContentSecurityPolicy != "" {
+			c.Header("Content-Security-Policy", h.ContentSecurityPolicy)
+		}
+		if h.FrameOptions != "" {
+			c.Header("X-Frame-Options", h.FrameOptions)
+		}
+		if h.ReferrerPolicy != "" {
+			c.Header("Referrer-Policy", h.ReferrerPolicy)
+		}
+		if h.NoSniff {
+			c.Header("X-Content-Type-Options", "nosniff")
+		}
+	}
+}
+
+// WithBodyLimit rejects request bodies over limit bytes with 413, 0 disables
+// the production default of DefaultBodyLimit
+func WithBodyLimit(limit int64) Option {
+	return func(s *Srv) {
+		s.bodyLimit = limit
+	}
+}
+
+// bodyLimit is the middleware limiting request bodies
+func bodyLimit(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > limit {
+			Abort(c, fmt.Errorf("%w: %d bytes", ErrBodyTooLarge, c.Request.ContentLength))
+			return
+		}
+		if c.Request.Body != nil && c.Request.Body != http.NoBody {
+			c.Request.Body = &limitedBody{ReadCloser: c.Request.Body, remaining: limit}
+		}
+	}
+}
+
+// hardening returns the security headers and body limit middleware
+// configured on s, they only set up the request so New can run them from a
+// single middleware installed before any route
+func (s *Srv) hardening() []gin.HandlerFunc {
+	var handlers []gin.HandlerFunc
+	if s.securityHeaders != nil {
+		handlers = append(handlers, securityHeaders(*s.securityHeaders))
+	}
+	if s.bodyLimit > 0 {
+		handlers = append(handlers, bodyLimit(s.bodyLimit))
+	}
+
+	return handlers
+}
+
+// limitedBody fails reads past the limit with ErrBodyTooLarge, unlike
+// http.MaxBytesReader its error can be matched by Abort
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+// Read implements io.Reader
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	// read one byte past the limit to tell a body of exactly limit bytes apart
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), ErrBodyTooLarge
+	}
+
+	return n, err
+}
+
+// WithTrustedProxies sets the proxies whose forwarding headers are trusted for
+// the client ip, without it gin trusts X-Forwarded-For from any peer
+func WithTrustedProxies(proxies ...string) Option {
+	return func(s *Srv) {
+		if err := s.router.SetTrustedProxies(proxies); err != nil {
+			s.err = fmt.Errorf("failed to set trusted proxies: %w", err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// readiness, liveness and dependency health checks
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultCheckTimeout is used for checks registered without a timeout
+const DefaultCheckTimeout = 2 * time.Second
+
+// health statuses reported by /livez, /readyz and each check
+const (
+	HealthOK          = "ok"
+	HealthDegraded    = "degraded"
+	HealthUnavailable = "unavailable"
+	HealthFailed      = "failed"
+)
+
+// errors
+var (
+	ErrCheckName      = errors.New("health check requires a name and checker")
+	ErrDuplicateCheck = errors.New("health check already registered")
+	ErrCheckTimeout   = errors.New("health check timed out")
+)
+
+// Checker reports whether a dependency is healthy
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc adapts a function to a Checker
+type CheckerFunc func(ctx context.Context) error
+
+// Check implements Checker
+func (f CheckerFunc) Check(ctx context.Context) error { return f(ctx) }
+
+// Check is a named health check
+type Check struct {
+	Name    string
+	Checker Checker
+	// Timeout bounds each run, defaults to DefaultCheckTimeout
+	Timeout time.Duration
+	// Critical checks mark the service not ready when failing, others only
+	// report the service as degraded
+	Critical bool
+	// Liveness checks also run on /livez, a failure there restarts the pod so
+	// only use it for checks the process can't recover from, not dependencies
+	Liveness bool
+	// CacheTTL reuses the last result for this long to protect dependencies
+	// from frequent probes
+	CacheTTL time.Duration
+}
+
+// CheckResult is the outcome of a check
+type CheckResult struct {
+	Status   string    `json:"status"`
+	Critical bool      `json:"critical"`
+	Error    string    `json:"error,omitempty"`
+	Duration string    `json:"duration"`
+	Checked  time.Time `json:"checked_at"`
+	Cached   bool      `json:"cached,omitempty"`
+}
+
+// HealthReport is the response of /livez and /readyz
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Health runs the registered checks for the /livez and /readyz endpoints
+type Health struct {
+	mu     sync.RWMutex
+	checks []*healthCheck
+}
+
+// healthCheck is a registered check and its cached result
+type healthCheck struct {
+	Check
+
+	mu     sync.Mutex
+	result CheckResult
+}
+
+// NewHealth creates a health subsystem without checks
+func NewHealth() *Health {
+	return &Health{}
+}
+
+// Register adds a check, names must be unique
+func (h *Health) Register(check Check) error {
+	if check.Name == "" || check.Checker == nil {
+		return ErrCheckName
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = DefaultCheckTimeout
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, existing := range h.checks {
+		if existing.Name == check.Name {
+			return fmt.Errorf("%w: %s", ErrDuplicateCheck, check.Name)
+		}
+	}
+	h.checks = append(h.checks, &healthCheck{Check: check})
+
+	return nil
+}
+
+// Liveness runs the liveness checks
+func (h *Health) Liveness(ctx context.Context) HealthReport {
+	return h.run(ctx, func(check *healthCheck) bool { return check.Liveness })
+}
+
+// Readiness runs every check
+func (h *Health) Readiness(ctx context.Context) HealthReport {
+	return h.run(ctx, func(*healthCheck) bool { return true })
+}
+
+// Livez is the liveness endpoint, 503 when a liveness check fails
+func (h *Health) Livez() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writeReport(c, h.Liveness(c.Request.Context()))
+	}
+}
+
+// Readyz is the readiness endpoint, 503 when a critical check fails or
+// ready reports false such as while the server drains
+func (h *Health) Readyz(ready func() bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ready != nil && !ready() {
+			writeReport(c, HealthReport{Status: HealthUnavailable})
+			return
+		}
+		writeReport(c, h.Readiness(c.Request.Context()))
+	}
+}
+
+// writeReport responds with the report, only unavailable is a failure
+func writeReport(c *gin.Context, report HealthReport) {
+	status := http.StatusOK
+	if report.Status == HealthUnavailable {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
+
+// run runs the selected checks concurrently
+func (h *Health) run(ctx context.Context, selected func(*healthCheck) bool) HealthReport {
+	h.mu.RLock()
+	var checks []*healthCheck
+	for _, check := range h.checks {
+		if selected(check) {
+			checks = append(checks, check)
+		}
+	}
+	h.mu.RUnlock()
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check *healthCheck) {
+			defer wg.Done()
+			results[i] = check.run(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := HealthReport{Status: HealthOK, Checks: make(map[string]CheckResult, len(checks))}
+	for i, check := range checks {
+		result := results[i]
+		report.Checks[check.Name] = result
+		if result.Status == HealthOK {
+			continue
+		}
+		if check.Critical {
+			report.Status = HealthUnavailable
+		} else if report.Status == HealthOK {
+			report.Status = HealthDegraded
+		}
+	}
+
+	return report
+}
+
+// run returns the cached result or runs the check within its timeout
+func (check *healthCheck) run(ctx context.Context) CheckResult {
+	check.mu.Lock()
+	defer check.mu.Unlock()
+
+	now := timeNow()
+	if check.CacheTTL > 0 && !check.result.Checked.IsZero() && now.Sub(check.result.Checked) < check.CacheTTL {
+		result := check.result
+		result.Cached = true
+
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, check.Timeout)
+	defer cancel()
+
+	// checkers ignoring the context still can't block the probe
+	done := make(chan error, 1)
+	go func() { done <- check.Checker.Check(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ErrCheckTimeout
+	}
+
+	result := CheckResult{
+		Status:   HealthOK,
+		Critical: check.Critical,
+		Duration: timeNow().Sub(now).String(),
+		Checked:  now,
+	}
+	if err != nil {
+		result.Status = HealthFailed
+		result.Error = err.Error()
+	}
+	check.result = result
+
+	return result
+}
@@ -0,0 +1,125 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestHealth(t *testing.T) {
+	fixedNow(t, time.Unix(1651406400, 0))
+
+	var dbCalls int32
+	var dbErr atomic.Value
+	dbErr.Store("")
+	h := NewHealth()
+	checks := []Check{
+		{Name: "db", Critical: true, CacheTTL: time.Minute, Checker: CheckerFunc(func(context.Context) error {
+			atomic.AddInt32(&dbCalls, 1)
+			if msg := dbErr.Load().(string); msg != "" {
+				return errors.New(msg)
+			}
+			return nil
+		})},
+		{Name: "search", Timeout: 10 * time.Millisecond, Checker: CheckerFunc(func(context.Context) error {
+			time.Sleep(time.Second) // ignores the context
+			return nil
+		})},
+		{Name: "deadlock", Liveness: true, Checker: CheckerFunc(func(context.Context) error { return nil })},
+	}
+	for _, check := range checks {
+		if err := h.Register(check); err != nil {
+			t.Fatalf("Failed to register %s: %s", check.Name, err)
+		}
+	}
+	if err := h.Register(checks[0]); !errors.Is(err, ErrDuplicateCheck) {
+		t.Fatalf("Expected duplicate error, got %v", err)
+	}
+
+	var ready int32 = 1
+	router := gin.New()
+	router.GET("/livez", h.Livez())
+	router.GET("/readyz", h.Readyz(func() bool { return atomic.LoadInt32(&ready) == 1 }))
+	probe := func(path string) (int, HealthReport) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var report HealthReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Failed to decode report: %s", err)
+		}
+		return w.Code, report
+	}
+
+	code, report := probe("/readyz")
+	if code != http.StatusOK || report.Status != HealthDegraded {
+		t.Fatalf("Non critical failure should degrade: %d %+v", code, report)
+	}
+	if report.Checks["search"].Error != ErrCheckTimeout.Error() {
+		t.Fatalf("Expected timeout: %+v", report.Checks["search"])
+	}
+
+	// the failure is hidden by the cached result until it expires
+	dbErr.Store("connection refused")
+	if _, report := probe("/readyz"); !report.Checks["db"].Cached || report.Checks["db"].Status != HealthOK {
+		t.Fatalf("Expected cached db result: %+v", report.Checks["db"])
+	}
+	fixedNow(t, time.Unix(1651406400, 0).Add(2*time.Minute))
+	code, report = probe("/readyz")
+	if code != http.StatusServiceUnavailable || report.Checks["db"].Error != "connection refused" {
+		t.Fatalf("Critical failure should be unavailable: %d %+v", code, report)
+	}
+	if n := atomic.LoadInt32(&dbCalls); n != 2 {
+		t.Fatalf("Unexpected db check count: %d", n)
+	}
+
+	code, report = probe("/livez")
+	if code != http.StatusOK || len(report.Checks) != 1 || report.Checks["deadlock"].Status != HealthOK {
+		t.Fatalf("Liveness should ignore dependencies: %d %+v", code, report)
+	}
+
+	atomic.StoreInt32(&ready, 0)
+	if code, _ := probe("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected not ready while draining: %d", code)
+	}
+}
+
+func TestHTTPChecker(t *testing.T) {
+	var status int32 = http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	check := HTTPChecker(nil, srv.URL)
+	if err := check.Check(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	atomic.StoreInt32(&status, http.StatusBadGateway)
+	if err := check.Check(context.Background()); !errors.Is(err, ErrHealthStatus) {
+		t.Fatalf("Expected status error, got %v", err)
+	}
+}
+
+func TestBoltChecker(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "health.db"), 0o600, nil)
+	if err != nil {
+		t.Fatalf("Failed to open bolt: %s", err)
+	}
+	check := BoltChecker(db)
+	if err := check.Check(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	db.Close()
+	if err := check.Check(context.Background()); err == nil {
+		t.Fatal("Expected an error on a closed database")
+	}
+}
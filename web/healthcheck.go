@@ -0,0 +1,88 @@
+// built-in health checkers for common dependencies
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/jackc/pgx"
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// errors
+var (
+	ErrHealthStatus = errors.New("unhealthy status code")
+)
+
+// PgxExecer is implemented by *pgx.Conn and *pgx.ConnPool
+type PgxExecer interface {
+	ExecEx(ctx context.Context, sql string, options *pgx.QueryExOptions, arguments ...interface{}) (pgx.CommandTag, error)
+}
+
+// PgxChecker checks postgres by running an empty query
+func PgxChecker(db PgxExecer) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		if _, err := db.ExecEx(ctx, ";", nil); err != nil {
+			return fmt.Errorf("failed to ping postgres: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// EtcdChecker checks etcd by reading the health key, permission denied still
+// proves the cluster has quorum
+func EtcdChecker(client *clientv3.Client) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		_, err := client.Get(ctx, "health")
+		if err != nil && !errors.Is(err, rpctypes.ErrPermissionDenied) {
+			return fmt.Errorf("failed to reach etcd: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// BoltChecker checks that a read transaction can be opened on the bbolt database
+func BoltChecker(db *bolt.DB) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		if err := db.View(func(*bolt.Tx) error { return nil }); err != nil {
+			return fmt.Errorf("failed to read bolt database: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// HTTPChecker checks that a GET of url responds below 400, client defaults to
+// http.DefaultClient
+func HTTPChecker(client *http.Client, url string) Checker {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return CheckerFunc(func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create health request: %w", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to reach %s: %w", url, err)
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+		if resp.StatusCode >= http.StatusBadRequest {
+			return fmt.Errorf("%w: %s %d", ErrHealthStatus, url, resp.StatusCode)
+		}
+
+		return nil
+	})
+}
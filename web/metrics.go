@@ -0,0 +1,186 @@
+// prometheus http metrics and the /metrics endpoint
+package web
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/threecommaio/opc/metric"
+)
+
+const (
+	// DefaultMetricsPath is where metrics are served unless configured
+	DefaultMetricsPath = "/metrics"
+
+	// routeUnmatched labels requests without a route so unknown paths can't
+	// grow the label cardinality
+	routeUnmatched = "unmatched"
+)
+
+// MetricsConfig configures the http metrics installed by WithMetrics
+type MetricsConfig struct {
+	// Registry provides the registerer, gatherer and namespace when set, its
+	// definitions are served under Path for cmd/dashboard
+	Registry *metric.Registry
+	// Registerer and Gatherer default to the prometheus default registry
+	Registerer prometheus.Registerer
+	Gatherer   prometheus.Gatherer
+	// Namespace prefixes the metric names
+	Namespace string
+	// Buckets are the latency histogram buckets in seconds, defaults to prometheus.DefBuckets
+	Buckets []float64
+	// Path serves the metrics, defaults to DefaultMetricsPath
+	Path string
+	// AdminAddress serves the metrics on a separate listener such as :9090
+	// instead of the main one, keeping them off public ingress
+	AdminAddress string
+}
+
+// httpMetrics are the collectors recorded by the middleware
+type httpMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight *prometheus.GaugeVec
+}
+
+// WithMetrics records request counts, latency and in-flight requests labelled
+// by route template, method and status, and serves /metrics. Routes registered
+// by New such as the health probes are not recorded.
+func WithMetrics(cfg MetricsConfig) Option {
+	return func(s *Srv) {
+		if cfg.Registry != nil {
+			cfg.Registerer = cfg.Registry.Registerer()
+			cfg.Gatherer = cfg.Registry.Gatherer()
+			cfg.Namespace = cfg.Registry.Namespace()
+		}
+		if cfg.Registerer == nil {
+			cfg.Registerer = prometheus.DefaultRegisterer
+		}
+		if cfg.Gatherer == nil {
+			cfg.Gatherer = prometheus.DefaultGatherer
+		}
+		if cfg.Buckets == nil {
+			cfg.Buckets = prometheus.DefBuckets
+		}
+		if cfg.Path == "" {
+			cfg.Path = DefaultMetricsPath
+		}
+
+		m, err := newHTTPMetrics(cfg)
+		if err != nil {
+			s.err = err
+			return
+		}
+		handler := promhttp.InstrumentMetricHandler(cfg.Registerer,
+			promhttp.HandlerFor(cfg.Gatherer, promhttp.HandlerOpts{}))
+
+		if cfg.AdminAddress != "" {
+			mux := http.NewServeMux()
+			mux.Handle(cfg.Path, handler)
+			if cfg.Registry != nil {
+				mux.Handle(cfg.Path+metric.DefinitionsSuffix, cfg.Registry.DefinitionsHandler())
+			}
+			s.admin = &http.Server{
+				Addr:        cfg.AdminAddress,
+				Handler:     mux,
+				ReadTimeout: s.server.ReadTimeout,
+			}
+		} else {
+			s.router.GET(cfg.Path, gin.WrapH(handler))
+			if cfg.Registry != nil {
+				s.router.GET(cfg.Path+metric.DefinitionsSuffix, gin.WrapH(cfg.Registry.DefinitionsHandler()))
+			}
+		}
+		s.router.Use(m.middleware())
+	}
+}
+
+// newHTTPMetrics registers the collectors, reusing ones already registered so
+// several servers can share a registry
+func newHTTPMetrics(cfg MetricsConfig) (*httpMetrics, error) {
+	labels := []string{"route", "method", "status"}
+
+	requests, err := registerCollector(cfg.Registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: cfg.Namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status.",
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+	duration, err := registerCollector(cfg.Registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: cfg.Namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route, method and status.",
+		Buckets:   cfg.Buckets,
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+	inFlight, err := registerCollector(cfg.Registerer, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: cfg.Namespace,
+		Name:      "http_requests_in_flight",
+		Help:      "HTTP requests currently being served by route and method.",
+	}, []string{"route", "method"}))
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpMetrics{requests: requests, duration: duration, inFlight: inFlight}, nil
+}
+
+// registerCollector registers c or returns the identical collector already
+// registered, a conflicting collector such as one with other labels is an error
+func registerCollector[T prometheus.Collector](r prometheus.Registerer, c T) (T, error) {
+	if err := r.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing, nil
+			}
+		}
+
+		return c, fmt.Errorf("failed to register metric: %w", err)
+	}
+
+	return c, nil
+}
+
+// middleware records each request
+func (m *httpMetrics) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" {
+			route = routeUnmatched
+		}
+		method := c.Request.Method
+
+		inFlight := m.inFlight.WithLabelValues(route, method)
+		inFlight.Inc()
+		start := time.Now()
+		defer func() {
+			inFlight.Dec()
+			status := strconv.Itoa(c.Writer.Status())
+			// gin.Recovery runs before this middleware and only writes the 500
+			// once the panic reaches it
+			r := recover()
+			if r != nil {
+				status = strconv.Itoa(http.StatusInternalServerError)
+			}
+			m.requests.WithLabelValues(route, method, status).Inc()
+			m.duration.WithLabelValues(route, method, status).Observe(time.Since(start).Seconds())
+			if r != nil {
+				panic(r)
+			}
+		}()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,162 @@
+package web
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/threecommaio/opc/metric"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	_, router, err := New(SrvConfig{ReadTimeout: "10s", WriteTimeout: "10s"},
+		WithMetrics(MetricsConfig{Registerer: registry, Gatherer: registry}))
+	if err != nil {
+		t.Fatalf("Server setup failed: %s", err)
+	}
+	router.GET("/users/:id", func(c *gin.Context) {
+		c.String(http.StatusOK, c.Param("id"))
+	})
+
+	for _, path := range []string{"/users/1", "/users/2", "/missing/1", "/readyz"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	want := `
+# HELP http_requests_total HTTP requests by route, method and status.
+# TYPE http_requests_total counter
+http_requests_total{method="GET",route="/users/:id",status="200"} 2
+http_requests_total{method="GET",route="unmatched",status="404"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "http_requests_total"); err != nil {
+		t.Fatalf("Unexpected metrics: %s", err)
+	}
+	if n, err := testutil.GatherAndCount(registry, "http_request_duration_seconds"); err != nil || n != 2 {
+		t.Fatalf("Unexpected histogram series: %d %v", n, err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, DefaultMetricsPath, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "http_request_duration_seconds_bucket") {
+		t.Fatalf("Unexpected metrics response: %d %s", w.Code, w.Body.String())
+	}
+
+	// a second server sharing the registry must not panic
+	if _, _, err := New(SrvConfig{ReadTimeout: "10s", WriteTimeout: "10s"},
+		WithMetrics(MetricsConfig{Registerer: registry, Gatherer: registry})); err != nil {
+		t.Fatalf("Server setup failed: %s", err)
+	}
+
+	// the same name with other labels is an error rather than a panic
+	conflicting := prometheus.NewRegistry()
+	conflicting.MustRegister(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total", Help: "HTTP requests by route, method and status.",
+	}, []string{"path"}))
+	if _, _, err := New(SrvConfig{ReadTimeout: "10s", WriteTimeout: "10s"},
+		WithMetrics(MetricsConfig{Registerer: conflicting, Gatherer: conflicting})); err == nil {
+		t.Fatalf("Expected a conflicting metric to fail server setup")
+	}
+}
+
+func TestMetricsAdminListener(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	s, router, err := New(SrvConfig{ReadTimeout: "10s", WriteTimeout: "10s"}, WithListener(l),
+		WithMetrics(MetricsConfig{Registerer: registry, Gatherer: registry, AdminAddress: "127.0.0.1:0"}))
+	if err != nil {
+		t.Fatalf("Server setup failed: %s", err)
+	}
+	router.GET("/ping", func(c *gin.Context) { c.String(http.StatusOK, "pong") })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if err := s.StartContext(ctx); err != nil {
+			t.Errorf("Server failed: %s", err)
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.AdminAddr() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.AdminAddr() == nil {
+		t.Fatal("Admin listener never started")
+	}
+
+	if _, err := get(t, http.DefaultClient, "http://"+l.Addr().String()+"/ping"); err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	resp, err := http.Get("http://" + l.Addr().String() + DefaultMetricsPath)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Metrics should not be served on the main listener: %d", resp.StatusCode)
+	}
+
+	body, err := get(t, http.DefaultClient, "http://"+s.AdminAddr().String()+DefaultMetricsPath)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	if !strings.Contains(body, `http_requests_total{method="GET",route="/ping",status="200"} 1`) {
+		t.Fatalf("Unexpected admin metrics: %s", body)
+	}
+}
+
+func TestMetricsPanic(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	_, router, err := New(SrvConfig{ReadTimeout: "10s", WriteTimeout: "10s"},
+		WithMetrics(MetricsConfig{Registerer: registry, Gatherer: registry}))
+	if err != nil {
+		t.Fatalf("Server setup failed: %s", err)
+	}
+	router.GET("/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Unexpected status: %d", w.Code)
+	}
+	want := `
+# HELP http_requests_total HTTP requests by route, method and status.
+# TYPE http_requests_total counter
+http_requests_total{method="GET",route="/panic",status="500"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "http_requests_total"); err != nil {
+		t.Fatalf("Unexpected metrics: %s", err)
+	}
+}
+
+func TestMetricsRegistryDefinitions(t *testing.T) {
+	local := prometheus.NewRegistry()
+	registry := metric.NewRegistry(metric.Config{Service: "api", Env: "test", Namespace: "api", Registerer: local, Gatherer: local})
+	if _, err := registry.Counter("jobs_total", "Jobs processed."); err != nil {
+		t.Fatalf("Failed to register: %s", err)
+	}
+	_, router, err := New(SrvConfig{ReadTimeout: "10s", WriteTimeout: "10s"}, WithMetrics(MetricsConfig{Registry: registry}))
+	if err != nil {
+		t.Fatalf("Server setup failed: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, DefaultMetricsPath+metric.DefinitionsSuffix, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"api_jobs_total"`) {
+		t.Fatalf("Unexpected definitions response: %d %s", w.Code, w.Body.String())
+	}
+}
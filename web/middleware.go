@@ -5,97 +5,80 @@ import (
 	"bytes"
 	"errors"
 	"io/ioutil"
-	"os"
 
 	"github.com/gin-gonic/gin"
-	log "github.com/sirupsen/logrus"
 
 	"github.com/threecommaio/opc/core"
 )
 
 var (
-	SlackSignature  = Signature{Header: HeaderSlack, Env: "SLACK_WEBHOOK_SECRET", IsValid: SlackValidator}
+	SlackSignature = Signature{Name: "slack", Header: HeaderSlack, Env: "SLACK_WEBHOOK_SECRET",
+		IsValid: SlackValidator, Delivery: SlackDelivery}
 	SlackChallenge  = Challenge{Header: HeaderSlack, Env: "SLACK_WEBHOOK_SECRET", IsValid: SlackChallengeValidator}
-	GithubSignature = Signature{Header: HeaderGithub, Env: "GH_WEBHOOK_SECRET", IsValid: GithubValidator}
-	LinearSignature = Signature{Header: HeaderLinear, Env: "LINEAR_WEBHOOK_SECRET", IsValid: LinearValidator}
-	// allSignatures we should verify if they exist
-	allSignatures []Signature = []Signature{SlackSignature, GithubSignature, LinearSignature}
-	allChallenges []Challenge = []Challenge{SlackChallenge}
+	GithubSignature = Signature{Name: "github", Header: HeaderGithub, Env: "GH_WEBHOOK_SECRET",
+		IsValid: GithubValidator, Delivery: GithubDelivery}
+	LinearSignature = Signature{Name: "linear", Header: HeaderLinearSignature, Env: "LINEAR_WEBHOOK_SECRET",
+		IsValid: LinearValidator, Delivery: LinearDelivery}
+	StripeSignature = Signature{Name: "stripe", Header: HeaderStripe, Env: "STRIPE_WEBHOOK_SECRET",
+		IsValid: StripeValidator, Delivery: StripeDelivery}
+	TwilioSignature = Signature{Name: "twilio", Header: HeaderTwilio, Env: "TWILIO_AUTH_TOKEN",
+		IsValid: TwilioValidator, Delivery: TwilioDelivery}
+	ShopifySignature = Signature{Name: "shopify", Header: HeaderShopify, Env: "SHOPIFY_WEBHOOK_SECRET",
+		IsValid: ShopifyValidator, Delivery: ShopifyDelivery}
 )
 
+// ContextKeyRawBody is the gin context key caching the raw request body
+const ContextKeyRawBody = "web.raw_body"
+
 // errors
 var (
 	ErrNoSignature = errors.New("no signature found")
 )
 
-// WebhookChallenge is a middleware for validating webhook challenge
-func WebhookChallenge(opts ...Challenge) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		data, err := c.GetRawData()
-		if IsError(c, err) {
-			return
-		}
-		if opts == nil {
-			opts = append(opts, allChallenges...)
-		}
-
-		for _, challenge := range opts {
-			_, ok := c.Request.Header[challenge.Header]
-			if ok {
-				secret := os.Getenv(challenge.Env)
-				err := challenge.IsValid(c, data, secret)
-				if IsError401(c, err) {
-					return
-				}
-				break
-			}
-		}
+// RawBody returns the raw request body reading it only once per request, the
+// request body is restored every call so handlers can still bind it
+func RawBody(c *gin.Context) ([]byte, error) {
+	if cached, ok := c.Get(ContextKeyRawBody); ok {
+		data := cached.([]byte)
 		c.Request.Body = ioutil.NopCloser(bytes.NewBuffer(data))
-		c.Next()
+
+		return data, nil
 	}
+	data, err := c.GetRawData()
+	if err != nil {
+		return nil, err
+	}
+	c.Set(ContextKeyRawBody, data)
+	c.Request.Body = ioutil.NopCloser(bytes.NewBuffer(data))
+
+	return data, nil
 }
 
-// WebhookSecretValidation is a middleware for validating webhook signature
-func WebhookSecretValidation(opts ...Signature) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		data, err := c.GetRawData()
-		if IsError(c, err) {
-			return
-		}
+// WebhookChallenge is a middleware for validating webhook challenge, it
+// defaults to the challenges of DefaultSignatureRegistry
+func WebhookChallenge(opts ...Challenge) gin.HandlerFunc {
+	if opts == nil {
+		return DefaultSignatureRegistry().ChallengeValidation()
+	}
 
-		// skip validation if not in production
-		if !IsSecretValidateEnabled() {
-			log.Warning("skipping secret validation not in production")
-			c.Next()
-			return
-		}
+	return (&SignatureRegistry{challenges: opts}).ChallengeValidation()
+}
 
-		if opts == nil {
-			opts = append(opts, allSignatures...)
-		}
-		valid := false
-		for _, signature := range opts {
-			_, ok := c.Request.Header[signature.Header]
-			if ok {
-				secret := os.Getenv(signature.Env)
-				err := signature.IsValid(c, data, secret)
-				if IsError401(c, err) {
-					return
-				}
-				valid = true
-				break
-			}
-		}
-		// if no signature found, return error
-		if !valid && IsError401(c, ErrNoSignature) {
-			return
-		}
-		c.Request.Body = ioutil.NopCloser(bytes.NewBuffer(data))
-		c.Next()
+// WebhookSecretValidation is a middleware for validating webhook signature, it
+// defaults to the signatures of DefaultSignatureRegistry and is enforced in
+// every environment, use SignatureRegistry.SecretValidation to set a policy
+func WebhookSecretValidation(opts ...Signature) gin.HandlerFunc {
+	if opts == nil {
+		return DefaultSignatureRegistry().SecretValidation()
 	}
+
+	return (&SignatureRegistry{signatures: opts}).SecretValidation()
 }
 
 // IsSecretValidateEnabled checks if secret validation should be enabled
+//
+// Deprecated: validation is enforced in every environment, use WithPolicy to
+// relax it explicitly.
 func IsSecretValidateEnabled() bool {
 	return core.Environment() == core.Production
 }
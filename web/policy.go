@@ -0,0 +1,110 @@
+// enforcement policy for webhook signature validation
+package web
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/threecommaio/opc/metric"
+)
+
+// ValidationPolicy controls how webhook signature failures are handled
+type ValidationPolicy int
+
+const (
+	// PolicyEnforce rejects requests failing validation, the default everywhere
+	PolicyEnforce ValidationPolicy = iota
+	// PolicyLogOnly logs failures and lets the request through
+	PolicyLogOnly
+	// PolicyDisabled skips validation
+	PolicyDisabled
+)
+
+// validation results reported by the webhook validation metric
+const (
+	resultVerified = "verified"
+	resultFailed   = "failed"
+	resultSkipped  = "skipped"
+)
+
+// errors
+var (
+	ErrParsePolicy = errors.New("failed to parse validation policy")
+)
+
+// ValidationMetrics counts webhook signature validations by provider and result
+type ValidationMetrics struct {
+	validations *prometheus.CounterVec
+}
+
+// NewValidationMetrics registers webhook_validations_total on r, pass it to
+// the validation middleware with WithValidationMetrics
+func NewValidationMetrics(r *metric.Registry) (*ValidationMetrics, error) {
+	validations, err := r.Counter("webhook_validations_total",
+		"Webhook signature validations by provider and result.", "provider", "result")
+	if err != nil {
+		return nil, err
+	}
+
+	return &ValidationMetrics{validations: validations}, nil
+}
+
+// observe counts a validation, a nil ValidationMetrics counts nothing
+func (m *ValidationMetrics) observe(provider, result string) {
+	if m == nil {
+		return
+	}
+	m.validations.WithLabelValues(provider, result).Inc()
+}
+
+// String returns the name of the policy
+func (p ValidationPolicy) String() string {
+	switch p {
+	case PolicyEnforce:
+		return "enforce"
+	case PolicyLogOnly:
+		return "log-only"
+	case PolicyDisabled:
+		return "disabled"
+	}
+
+	return "unknown"
+}
+
+// ParseValidationPolicy parses enforce, log-only or disabled, as read from config
+func ParseValidationPolicy(s string) (ValidationPolicy, error) {
+	switch s {
+	case "", "enforce":
+		return PolicyEnforce, nil
+	case "log-only":
+		return PolicyLogOnly, nil
+	case "disabled":
+		return PolicyDisabled, nil
+	}
+
+	return PolicyEnforce, fmt.Errorf("%w: %s", ErrParsePolicy, s)
+}
+
+// ValidationOption is used for configuring the secret validation middleware
+type ValidationOption func(*validationConfig)
+
+type validationConfig struct {
+	policy  ValidationPolicy
+	metrics *ValidationMetrics
+}
+
+// WithPolicy sets the validation policy, defaults to PolicyEnforce
+func WithPolicy(policy ValidationPolicy) ValidationOption {
+	return func(cfg *validationConfig) {
+		cfg.policy = policy
+	}
+}
+
+// WithValidationMetrics counts validations, see NewValidationMetrics
+func WithValidationMetrics(m *ValidationMetrics) ValidationOption {
+	return func(cfg *validationConfig) {
+		cfg.metrics = m
+	}
+}
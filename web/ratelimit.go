@@ -0,0 +1,378 @@
+// rate limiting middleware with local and etcd backed stores
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/ratelimit"
+)
+
+// rate limit response headers
+const (
+	HeaderRetryAfter         = "Retry-After"
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+)
+
+// DefaultEtcdRateLimitPrefix is where EtcdRateLimitStore keeps its counters
+const DefaultEtcdRateLimitPrefix = "/ratelimit/"
+
+// errors
+var (
+	ErrRateLimitContention = errors.New("rate limit counter contention")
+	ErrInvalidLimit        = errors.New("rate limit needs positive requests and period")
+)
+
+// Limit allows Requests per Period, the memory store also allows bursts of
+// up to Burst requests, defaulting to Requests
+type Limit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// validate rejects limits that can't be enforced
+func (l Limit) validate() error {
+	if l.Requests <= 0 || l.Period <= 0 {
+		return fmt.Errorf("%w: %d per %s", ErrInvalidLimit, l.Requests, l.Period)
+	}
+
+	return nil
+}
+
+// RateLimitResult is the outcome of taking a request from a limit
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// Reset is when the limit is fully available again
+	Reset time.Duration
+	// RetryAfter is when the next request is allowed, if denied
+	RetryAfter time.Duration
+}
+
+// RateLimitStore counts requests per key, shared stores let replicas enforce
+// one limit
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit Limit) (RateLimitResult, error)
+}
+
+// RateLimitKey returns the key requests are counted by, false skips the limit
+// for the request
+type RateLimitKey func(c *gin.Context) (string, bool)
+
+// KeyClientIP limits by client ip, configure trusted proxies so it isn't spoofed
+func KeyClientIP(c *gin.Context) (string, bool) {
+	return "ip:" + c.ClientIP(), true
+}
+
+// KeyHeader limits by a header such as an API key, requests without it are
+// skipped, values are hashed so keys aren't stored
+func KeyHeader(header string) RateLimitKey {
+	return func(c *gin.Context) (string, bool) {
+		v := c.GetHeader(header)
+		if v == "" {
+			return "", false
+		}
+		sum := sha256.Sum256([]byte(v))
+
+		return "header:" + hex.EncodeToString(sum[:16]), true
+	}
+}
+
+// KeyContext limits by a value set on the gin context such as the
+// authenticated subject, requests without it are skipped
+func KeyContext(contextKey string) RateLimitKey {
+	return func(c *gin.Context) (string, bool) {
+		v := c.GetString(contextKey)
+		if v == "" {
+			return "", false
+		}
+
+		return contextKey + ":" + v, true
+	}
+}
+
+// RateLimitConfig configures the RateLimit middleware
+type RateLimitConfig struct {
+	Limit Limit
+	// Key defaults to KeyClientIP
+	Key RateLimitKey
+	// Store defaults to a MemoryRateLimitStore
+	Store RateLimitStore
+	// PerRoute counts each route template separately
+	PerRoute bool
+}
+
+// RateLimit rejects requests over the limit with 429, setting Retry-After and
+// the RateLimit-* headers. Apply it to the engine, a group or single routes for
+// per route limits. Store errors let requests through. It panics on a limit
+// without requests or period, like gin does on invalid routes.
+//
+// go.uber.org/ratelimit only backs Throttle, it blocks until a request may
+// proceed and can't report whether one is allowed, so rejecting limits are
+// kept in a RateLimitStore which replicas can also share.
+func RateLimit(cfg RateLimitConfig) gin.HandlerFunc {
+	if err := cfg.Limit.validate(); err != nil {
+		panic(err)
+	}
+	if cfg.Key == nil {
+		cfg.Key = KeyClientIP
+	}
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryRateLimitStore()
+	}
+
+	return func(c *gin.Context) {
+		key, ok := cfg.Key(c)
+		if !ok {
+			c.Next()
+			return
+		}
+		if cfg.PerRoute {
+			key = c.Request.Method + " " + c.FullPath() + "|" + key
+		}
+
+		result, err := cfg.Store.Take(c.Request.Context(), key, cfg.Limit)
+		if err != nil {
+			Log(c).WithError(err).Warn("rate limit store failed, allowing request")
+			c.Next()
+			return
+		}
+
+		c.Header(HeaderRateLimitLimit, strconv.Itoa(cfg.Limit.Requests))
+		c.Header(HeaderRateLimitRemaining, strconv.Itoa(result.Remaining))
+		c.Header(HeaderRateLimitReset, strconv.Itoa(ceilSeconds(result.Reset)))
+		if !result.Allowed {
+			c.Header(HeaderRetryAfter, strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			Abort(c, fmt.Errorf("%w: %s", ErrRateLimited, key))
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Throttle paces requests to rps by delaying them with go.uber.org/ratelimit
+// instead of rejecting them, for smoothing bursts towards a fragile backend
+func Throttle(rps int) gin.HandlerFunc {
+	limiter := ratelimit.New(rps)
+
+	return func(c *gin.Context) {
+		limiter.Take()
+		c.Next()
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// MemoryRateLimitStore is a token bucket per key local to the process
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+// NewMemoryRateLimitStore creates an empty store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+}
+
+// Take implements RateLimitStore
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit Limit) (RateLimitResult, error) {
+	if err := limit.validate(); err != nil {
+		return RateLimitResult{}, err
+	}
+	capacity := float64(limit.Burst)
+	if limit.Burst <= 0 {
+		capacity = float64(limit.Requests)
+	}
+	rate := float64(limit.Requests) / limit.Period.Seconds() // tokens per second
+	now := timeNow()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	result := RateLimitResult{Allowed: b.tokens >= 1}
+	if result.Allowed {
+		b.tokens--
+	} else {
+		result.RetryAfter = secondsDuration((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = secondsDuration((capacity - b.tokens) / rate)
+	b.full = now.Add(result.Reset)
+
+	return result, nil
+}
+
+// sweep drops full buckets once a minute so idle keys don't accumulate
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// EtcdRateLimitStore counts requests in fixed windows in etcd so replicas
+// share a limit, counters expire with a lease at the end of their window that
+// every counter of the window shares
+type EtcdRateLimitStore struct {
+	client *clientv3.Client
+	prefix string
+
+	mu     sync.Mutex
+	leases map[etcdWindow]clientv3.LeaseID
+}
+
+// etcdWindow identifies a fixed window, limits with other periods have their own
+type etcdWindow struct {
+	period time.Duration
+	start  int64
+}
+
+// NewEtcdRateLimitStore creates a store keeping counters under prefix,
+// defaulting to DefaultEtcdRateLimitPrefix
+func NewEtcdRateLimitStore(client *clientv3.Client, prefix string) *EtcdRateLimitStore {
+	if prefix == "" {
+		prefix = DefaultEtcdRateLimitPrefix
+	}
+
+	return &EtcdRateLimitStore{client: client, prefix: prefix, leases: make(map[etcdWindow]clientv3.LeaseID)}
+}
+
+// etcdRateLimitAttempts bounds retries when replicas update a counter at once
+const etcdRateLimitAttempts = 5
+
+// Take implements RateLimitStore
+func (s *EtcdRateLimitStore) Take(ctx context.Context, key string, limit Limit) (RateLimitResult, error) {
+	if err := limit.validate(); err != nil {
+		return RateLimitResult{}, err
+	}
+	now := timeNow()
+	window := now.Truncate(limit.Period)
+	reset := window.Add(limit.Period).Sub(now)
+	counterKey := fmt.Sprintf("%s%s/%d", s.prefix, key, window.Unix())
+
+	for attempt := 0; attempt < etcdRateLimitAttempts; attempt++ {
+		resp, err := s.client.Get(ctx, counterKey)
+		if err != nil {
+			return RateLimitResult{}, fmt.Errorf("failed to read rate limit counter: %w", err)
+		}
+
+		var count int
+		var txn clientv3.Txn
+		if len(resp.Kvs) == 0 {
+			lease, err := s.lease(ctx, etcdWindow{period: limit.Period, start: window.Unix()}, reset)
+			if err != nil {
+				return RateLimitResult{}, err
+			}
+			txn = s.client.Txn(ctx).
+				If(clientv3.Compare(clientv3.CreateRevision(counterKey), "=", 0)).
+				Then(clientv3.OpPut(counterKey, "1", clientv3.WithLease(lease)))
+		} else {
+			kv := resp.Kvs[0]
+			count, err = strconv.Atoi(string(kv.Value))
+			if err != nil {
+				return RateLimitResult{}, fmt.Errorf("failed to parse rate limit counter: %w", err)
+			}
+			if count >= limit.Requests {
+				return RateLimitResult{Reset: reset, RetryAfter: reset}, nil
+			}
+			txn = s.client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(counterKey), "=", kv.ModRevision)).
+				Then(clientv3.OpPut(counterKey, strconv.Itoa(count+1), clientv3.WithIgnoreLease()))
+		}
+
+		txnResp, err := txn.Commit()
+		if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			// revoked early, such as by an etcd restore, grant another
+			s.forgetLease(etcdWindow{period: limit.Period, start: window.Unix()})
+			continue
+		}
+		if err != nil {
+			return RateLimitResult{}, fmt.Errorf("failed to update rate limit counter: %w", err)
+		}
+		if txnResp.Succeeded {
+			return RateLimitResult{Allowed: true, Remaining: limit.Requests - count - 1, Reset: reset}, nil
+		}
+	}
+
+	return RateLimitResult{}, fmt.Errorf("%w: %s", ErrRateLimitContention, key)
+}
+
+// lease returns the lease of the window, granting one lasting until the
+// window ends, and drops the leases of past windows
+func (s *EtcdRateLimitStore) lease(ctx context.Context, window etcdWindow, remaining time.Duration) (clientv3.LeaseID, error) {
+	s.mu.Lock()
+	id, ok := s.leases[window]
+	s.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	// granted outside the lock, a concurrent grant for the window just expires unused
+	lease, err := s.client.Grant(ctx, int64(ceilSeconds(remaining))+1)
+	if err != nil {
+		return 0, fmt.Errorf("failed to grant rate limit lease: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id, ok := s.leases[window]; ok {
+		return id, nil
+	}
+	now := timeNow()
+	for w := range s.leases {
+		if !now.Before(time.Unix(w.start, 0).Add(w.period)) {
+			delete(s.leases, w)
+		}
+	}
+	s.leases[window] = lease.ID
+
+	return lease.ID, nil
+}
+
+// forgetLease drops a lease etcd no longer knows
+func (s *EtcdRateLimitStore) forgetLease(window etcdWindow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.leases, window)
+}
@@ -0,0 +1,112 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimit(t *testing.T) {
+	now := time.Unix(1651406400, 0)
+	fixedNow(t, now)
+
+	store := NewMemoryRateLimitStore()
+	router := gin.New()
+	limited := router.Group("/", RateLimit(RateLimitConfig{
+		Limit: Limit{Requests: 2, Period: time.Minute}, Store: store, PerRoute: true,
+	}))
+	limited.GET("/a", func(c *gin.Context) { c.Status(http.StatusOK) })
+	limited.GET("/b", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/keyed", RateLimit(RateLimitConfig{
+		Limit: Limit{Requests: 1, Period: time.Minute}, Store: store, Key: KeyHeader("X-API-Key"),
+	}), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	do := func(path, ip, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = ip + ":1234"
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for i, want := range []string{"1", "0"} {
+		w := do("/a", "10.0.0.1", "")
+		if w.Code != http.StatusOK || w.Header().Get(HeaderRateLimitRemaining) != want {
+			t.Fatalf("Request %d: %d remaining %s", i, w.Code, w.Header().Get(HeaderRateLimitRemaining))
+		}
+	}
+	w := do("/a", "10.0.0.1", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", w.Code)
+	}
+	if w.Header().Get(HeaderRetryAfter) != "30" || w.Header().Get(HeaderRateLimitLimit) != "2" ||
+		w.Header().Get(HeaderRateLimitReset) != "60" {
+		t.Fatalf("Unexpected headers: %v", w.Header())
+	}
+
+	// routes and clients have their own buckets
+	if w := do("/b", "10.0.0.1", ""); w.Code != http.StatusOK {
+		t.Fatalf("Route limits should be separate: %d", w.Code)
+	}
+	if w := do("/a", "10.0.0.2", ""); w.Code != http.StatusOK {
+		t.Fatalf("Client limits should be separate: %d", w.Code)
+	}
+
+	// tokens refill over the period
+	fixedNow(t, now.Add(30*time.Second))
+	if w := do("/a", "10.0.0.1", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected a refilled token: %d", w.Code)
+	}
+
+	if w := do("/keyed", "10.0.0.1", ""); w.Code != http.StatusOK || w.Header().Get(HeaderRateLimitLimit) != "" {
+		t.Fatalf("Requests without a key should skip the limit: %d", w.Code)
+	}
+	if w := do("/keyed", "10.0.0.1", "key-1"); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: %d", w.Code)
+	}
+	if w := do("/keyed", "10.0.0.3", "key-1"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("API key limit should apply across ips: %d", w.Code)
+	}
+}
+
+func TestMemoryRateLimitStoreSweep(t *testing.T) {
+	now := time.Unix(1651406400, 0)
+	fixedNow(t, now)
+
+	store := NewMemoryRateLimitStore()
+	limit := Limit{Requests: 10, Period: time.Second}
+	if _, err := store.Take(context.Background(), "a", limit); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	fixedNow(t, now.Add(2*time.Minute))
+	if _, err := store.Take(context.Background(), "b", limit); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(store.buckets) != 1 {
+		t.Fatalf("Idle bucket was not swept: %d", len(store.buckets))
+	}
+}
+
+func TestInvalidLimit(t *testing.T) {
+	for _, limit := range []Limit{{Requests: 0, Period: time.Second}, {Requests: 10}} {
+		if _, err := NewMemoryRateLimitStore().Take(context.Background(), "k", limit); !errors.Is(err, ErrInvalidLimit) {
+			t.Fatalf("Unexpected error for %+v: %v", limit, err)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("Expected RateLimit to panic for %+v", limit)
+				}
+			}()
+			RateLimit(RateLimitConfig{Limit: limit})
+		}()
+	}
+}
@@ -0,0 +1,402 @@
+// registry of webhook providers and the secrets used to verify them
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/threecommaio/opc/core/hmac"
+)
+
+// ContextKeySecretID is the gin context key holding the id of the secret that
+// verified the webhook
+const ContextKeySecretID = "webhook.secret_id"
+
+// errors
+var (
+	ErrSignatureHeader    = errors.New("signature header is required")
+	ErrDuplicateSignature = errors.New("signature already registered for header")
+	ErrNoSecret           = errors.New("no webhook secret configured")
+)
+
+// SecretResolver resolves the secret used to verify a webhook provider
+type SecretResolver interface {
+	Secret(ctx context.Context) (string, error)
+}
+
+// SecretSource resolves every active secret of a provider so deliveries
+// signed with either the old or new secret verify while rotating
+type SecretSource interface {
+	Secrets(ctx context.Context) ([]hmac.Key, error)
+}
+
+// PreviousSecretSuffix names the variable holding the secret being rotated
+// out, such as GH_WEBHOOK_SECRET_PREVIOUS
+const PreviousSecretSuffix = "_PREVIOUS"
+
+// EnvSecret resolves a secret from the named environment variable, while
+// rotating the old secret is kept in the variable with PreviousSecretSuffix
+type EnvSecret string
+
+// Secret returns the value of the environment variable
+func (e EnvSecret) Secret(ctx context.Context) (string, error) {
+	return os.Getenv(string(e)), nil
+}
+
+// Secrets returns the secret and the previous one, identified by their
+// variable names
+func (e EnvSecret) Secrets(ctx context.Context) ([]hmac.Key, error) {
+	previous := string(e) + PreviousSecretSuffix
+
+	return []hmac.Key{
+		{ID: string(e), Secret: []byte(os.Getenv(string(e)))},
+		{ID: previous, Secret: []byte(os.Getenv(previous))},
+	}, nil
+}
+
+// FileSecret resolves a secret from a file such as a mounted kubernetes secret,
+// the file is read on every call so updates are picked up without a restart
+type FileSecret string
+
+// Secret returns the trimmed contents of the file
+func (f FileSecret) Secret(ctx context.Context) (string, error) {
+	data, err := os.ReadFile(string(f))
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Secrets returns each secret in the file, one per line
+func (f FileSecret) Secrets(ctx context.Context) ([]hmac.Key, error) {
+	data, err := os.ReadFile(string(f))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret file: %w", err)
+	}
+
+	return splitKeys(string(f), string(data), "\n"), nil
+}
+
+// StaticSecret is a secret known up front, for example loaded from config
+type StaticSecret string
+
+// Secret returns the static secret
+func (s StaticSecret) Secret(ctx context.Context) (string, error) {
+	return string(s), nil
+}
+
+// KeySet is a fixed set of secrets with their ids
+type KeySet []hmac.Key
+
+// Secret returns the first secret
+func (k KeySet) Secret(ctx context.Context) (string, error) {
+	if len(k) == 0 {
+		return "", nil
+	}
+
+	return string(k[0].Secret), nil
+}
+
+// Secrets returns the secrets
+func (k KeySet) Secrets(ctx context.Context) ([]hmac.Key, error) {
+	return k, nil
+}
+
+// SecretFunc adapts a function such as a secret manager lookup to a SecretResolver
+type SecretFunc func(ctx context.Context) (string, error)
+
+// Secret calls the function
+func (f SecretFunc) Secret(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+// SignatureRegistry holds the webhook providers a service accepts
+type SignatureRegistry struct {
+	mu         sync.RWMutex
+	signatures []Signature
+	challenges []Challenge
+}
+
+// NewSignatureRegistry creates an empty registry
+func NewSignatureRegistry() *SignatureRegistry {
+	return &SignatureRegistry{}
+}
+
+// DefaultSignatureRegistry creates a registry with slack, github and linear
+func DefaultSignatureRegistry() *SignatureRegistry {
+	return &SignatureRegistry{
+		signatures: []Signature{SlackSignature, GithubSignature, LinearSignature},
+		challenges: []Challenge{SlackChallenge},
+	}
+}
+
+// Register adds a webhook provider, the provider is selected when its header
+// is present on a request
+func (r *SignatureRegistry) Register(signature Signature) error {
+	if signature.Header == "" {
+		return ErrSignatureHeader
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range r.signatures {
+		if http.CanonicalHeaderKey(s.Header) == http.CanonicalHeaderKey(signature.Header) {
+			return fmt.Errorf("%w: %s", ErrDuplicateSignature, signature.Header)
+		}
+	}
+	r.signatures = append(r.signatures, signature)
+
+	return nil
+}
+
+// RegisterChallenge adds a webhook challenge handler
+func (r *SignatureRegistry) RegisterChallenge(challenge Challenge) error {
+	if challenge.Header == "" {
+		return ErrSignatureHeader
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.challenges {
+		if http.CanonicalHeaderKey(c.Header) == http.CanonicalHeaderKey(challenge.Header) {
+			return fmt.Errorf("%w: %s", ErrDuplicateSignature, challenge.Header)
+		}
+	}
+	r.challenges = append(r.challenges, challenge)
+
+	return nil
+}
+
+// Signatures returns the registered webhook providers
+func (r *SignatureRegistry) Signatures() []Signature {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]Signature(nil), r.signatures...)
+}
+
+// Challenges returns the registered webhook challenges
+func (r *SignatureRegistry) Challenges() []Challenge {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]Challenge(nil), r.challenges...)
+}
+
+// Match returns the provider whose header is present on the request
+func (r *SignatureRegistry) Match(header http.Header) (Signature, bool) {
+	for _, signature := range r.Signatures() {
+		if header.Get(signature.Header) != "" {
+			return signature, true
+		}
+	}
+
+	return Signature{}, false
+}
+
+// SecretValidation is a middleware validating the webhook signature of any
+// registered provider, requests without a known signature are rejected unless
+// the policy says otherwise
+func (r *SignatureRegistry) SecretValidation(opts ...ValidationOption) gin.HandlerFunc {
+	cfg := validationConfig{policy: PolicyEnforce}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return func(c *gin.Context) {
+		data, err := RawBody(c)
+		if IsError(c, err) {
+			return
+		}
+		if !r.validateRequest(c, data, cfg) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// validateRequest validates the webhook signature applying the policy and
+// reports whether the request may continue, aborting it otherwise
+func (r *SignatureRegistry) validateRequest(c *gin.Context, data []byte, cfg validationConfig) bool {
+	if cfg.policy == PolicyDisabled {
+		provider := "unknown"
+		if signature, ok := r.Match(c.Request.Header); ok {
+			provider = signature.Name
+		}
+		cfg.metrics.observe(provider, resultSkipped)
+		return true
+	}
+
+	signature, key, status, err := r.verify(c, data)
+	if err != nil {
+		cfg.metrics.observe(signature.Name, resultFailed)
+		if cfg.policy == PolicyLogOnly {
+			Log(c).WithField("provider", signature.Name).
+				Warnf("webhook validation failed, continuing due to log-only policy: %s", err)
+			return true
+		}
+		if status == http.StatusUnauthorized {
+			IsError401(c, err)
+		} else {
+			IsError(c, err)
+		}
+		return false
+	}
+	cfg.metrics.observe(signature.Name, resultVerified)
+	c.Set(ContextKeySecretID, key.ID)
+	Log(c).WithFields(log.Fields{"provider": signature.Name, "secret_id": key.ID}).
+		Debug("webhook signature verified")
+
+	return true
+}
+
+// verify validates the webhook signature and returns the provider, the key
+// that matched and the status to abort with on failure
+func (r *SignatureRegistry) verify(c *gin.Context, data []byte) (Signature, hmac.Key, int, error) {
+	signature, ok := r.Match(c.Request.Header)
+	// if no signature found, return error
+	if !ok {
+		return Signature{Name: "unknown"}, hmac.Key{}, http.StatusUnauthorized, ErrNoSignature
+	}
+	keys, err := resolveKeys(c.Request.Context(), signature.Secret, signature.Env)
+	if err != nil {
+		return signature, hmac.Key{}, http.StatusInternalServerError, err
+	}
+	key, err := hmac.MatchKey(keys, func(secret []byte) error {
+		return signature.IsValid(c, data, string(secret))
+	})
+	if err != nil {
+		return signature, hmac.Key{}, http.StatusUnauthorized, err
+	}
+
+	return signature, key, http.StatusOK, nil
+}
+
+// ChallengeValidation is a middleware answering webhook challenges of any
+// registered provider
+func (r *SignatureRegistry) ChallengeValidation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		data, err := RawBody(c)
+		if IsError(c, err) {
+			return
+		}
+
+		for _, challenge := range r.Challenges() {
+			if c.Request.Header.Get(challenge.Header) == "" {
+				continue
+			}
+			secret, err := resolveSecret(c.Request.Context(), challenge.Secret, challenge.Env)
+			if IsError(c, err) {
+				return
+			}
+			if IsError401(c, challenge.IsValid(c, data, secret)) {
+				return
+			}
+			break
+		}
+		c.Next()
+	}
+}
+
+// ReplayProtection is a middleware rejecting deliveries of any registered
+// provider that were already processed, see WebhookReplayProtection. A
+// delivery is forgotten again when the rest of the chain fails.
+func (r *SignatureRegistry) ReplayProtection(store ReplayStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		data, err := RawBody(c)
+		if IsError(c, err) {
+			return
+		}
+
+		signature, ok := r.Match(c.Request.Header)
+		if ok && signature.Delivery != nil {
+			delivery, err := signature.Delivery(c, data)
+			if IsError401(c, err) {
+				return
+			}
+			key, err := checkDelivery(store, signature.Header, delivery)
+			if errors.Is(err, ErrStaleDelivery) {
+				IsError401(c, err)
+				return
+			}
+			// store failures are ours, not a bad signature
+			if IsReplayed(c, err) || IsError(c, err) {
+				return
+			}
+			if key != "" {
+				defer releaseDelivery(c, store, key)
+			}
+		}
+		c.Next()
+	}
+}
+
+// resolveSecret resolves the secret falling back to the environment variable
+func resolveSecret(ctx context.Context, resolver SecretResolver, env string) (string, error) {
+	if resolver == nil {
+		resolver = EnvSecret(env)
+	}
+	secret, err := resolver.Secret(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve webhook secret: %w", err)
+	}
+
+	return secret, nil
+}
+
+// resolveKeys resolves every active secret falling back to the environment variable
+func resolveKeys(ctx context.Context, resolver SecretResolver, env string) ([]hmac.Key, error) {
+	if resolver == nil {
+		resolver = EnvSecret(env)
+	}
+
+	var keys []hmac.Key
+	if source, ok := resolver.(SecretSource); ok {
+		all, err := source.Secrets(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve webhook secrets: %w", err)
+		}
+		keys = all
+	} else {
+		secret, err := resolver.Secret(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve webhook secret: %w", err)
+		}
+		keys = []hmac.Key{{ID: env, Secret: []byte(secret)}}
+	}
+
+	// an empty secret would let anyone sign with an empty key
+	active := keys[:0:0]
+	for _, key := range keys {
+		if len(key.Secret) > 0 {
+			active = append(active, key)
+		}
+	}
+	if len(active) == 0 {
+		return nil, ErrNoSecret
+	}
+
+	return active, nil
+}
+
+// splitKeys splits value by sep into keys identified by name and index
+func splitKeys(name, value, sep string) []hmac.Key {
+	var keys []hmac.Key
+	for i, secret := range strings.Split(value, sep) {
+		keys = append(keys, hmac.Key{
+			ID:     fmt.Sprintf("%s[%d]", name, i),
+			Secret: []byte(strings.TrimSpace(secret)),
+		})
+	}
+
+	return keys
+}
@@ -0,0 +1,215 @@
+package web
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/threecommaio/opc/metric"
+)
+
+func sign(secret string, data []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSignatureRegistryRegister(t *testing.T) {
+	r := NewSignatureRegistry()
+	if err := r.Register(Signature{}); !errors.Is(err, ErrSignatureHeader) {
+		t.Fatalf("Expected missing header error, got %v", err)
+	}
+	if err := r.Register(GenericSignature("internal", HeaderGeneric, StaticSecret("s"))); err != nil {
+		t.Fatalf("Failed to register signature: %s", err)
+	}
+	err := r.Register(GenericSignature("other", "x-signature", StaticSecret("s")))
+	if !errors.Is(err, ErrDuplicateSignature) {
+		t.Fatalf("Expected duplicate header error, got %v", err)
+	}
+	if len(r.Signatures()) != 1 {
+		t.Fatalf("Unexpected signatures: %v", r.Signatures())
+	}
+
+	if err := r.RegisterChallenge(Challenge{}); !errors.Is(err, ErrSignatureHeader) {
+		t.Fatalf("Expected missing header error, got %v", err)
+	}
+	if err := r.RegisterChallenge(SlackChallenge); err != nil {
+		t.Fatalf("Failed to register challenge: %s", err)
+	}
+	challenge := SlackChallenge
+	challenge.Header = strings.ToLower(HeaderSlack)
+	if err := r.RegisterChallenge(challenge); !errors.Is(err, ErrDuplicateSignature) {
+		t.Fatalf("Expected duplicate header error, got %v", err)
+	}
+}
+
+func TestSignatureRegistrySecretValidation(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("file-secret\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write secret: %s", err)
+	}
+
+	r := NewSignatureRegistry()
+	for _, s := range []Signature{
+		GenericSignature("internal", HeaderGeneric, StaticSecret("static-secret")),
+		GenericSignature("mounted", "X-Mounted-Signature", FileSecret(secretFile)),
+		GenericSignature("broken", "X-Broken-Signature", SecretFunc(func(ctx context.Context) (string, error) {
+			return "", errors.New("secret manager unavailable")
+		})),
+		PagerDutySignature(StaticSecret("pd-secret")),
+	} {
+		if err := r.Register(s); err != nil {
+			t.Fatalf("Failed to register signature: %s", err)
+		}
+	}
+
+	router := gin.New()
+	router.POST("/webhook", r.SecretValidation(), func(c *gin.Context) {
+		data, _ := c.GetRawData()
+		c.String(http.StatusOK, string(data))
+	})
+
+	body := []byte(`{"event":"deploy"}`)
+	pdSignature := "v1=" + sign("old-secret", body)[len("sha256="):] + ", v1=" + sign("pd-secret", body)[len("sha256="):]
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"static", map[string]string{HeaderGeneric: sign("static-secret", body)}, http.StatusOK},
+		{"static wrong secret", map[string]string{HeaderGeneric: sign("file-secret", body)}, http.StatusUnauthorized},
+		{"file", map[string]string{"X-Mounted-Signature": sign("file-secret", body)}, http.StatusOK},
+		{"resolver error", map[string]string{"X-Broken-Signature": sign("", body)}, http.StatusInternalServerError},
+		{"pagerduty", map[string]string{HeaderPagerDuty: pdSignature}, http.StatusOK},
+		{"unknown provider", map[string]string{HeaderGithub: sign("static-secret", body)}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestContext(t, body, tt.headers)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, c.Request)
+			if w.Code != tt.want {
+				t.Fatalf("Unexpected status: got %d, want %d", w.Code, tt.want)
+			}
+			if w.Code == http.StatusOK && w.Body.String() != string(body) {
+				t.Fatalf("Body was not restored for the handler: %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSignatureRegistrySecretRotation(t *testing.T) {
+	t.Setenv("ROTATING_WEBHOOK_SECRET", "new,secret")
+	t.Setenv("ROTATING_WEBHOOK_SECRET"+PreviousSecretSuffix, "old-secret")
+	t.Setenv("EMPTY_WEBHOOK_SECRET", "")
+
+	r := NewSignatureRegistry()
+	for _, s := range []Signature{
+		GenericSignature("rotating", HeaderGeneric, EnvSecret("ROTATING_WEBHOOK_SECRET")),
+		GenericSignature("unset", "X-Unset-Signature", EnvSecret("EMPTY_WEBHOOK_SECRET")),
+	} {
+		if err := r.Register(s); err != nil {
+			t.Fatalf("Failed to register signature: %s", err)
+		}
+	}
+
+	router := gin.New()
+	router.POST("/webhook", r.SecretValidation(), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(ContextKeySecretID))
+	})
+
+	body := []byte(`{"event":"deploy"}`)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+		keyID   string
+	}{
+		{"old secret", map[string]string{HeaderGeneric: sign("old-secret", body)}, http.StatusOK, "ROTATING_WEBHOOK_SECRET_PREVIOUS"},
+		{"new secret with a comma", map[string]string{HeaderGeneric: sign("new,secret", body)}, http.StatusOK, "ROTATING_WEBHOOK_SECRET"},
+		{"part of the new secret", map[string]string{HeaderGeneric: sign("new", body)}, http.StatusUnauthorized, ""},
+		{"retired secret", map[string]string{HeaderGeneric: sign("older-secret", body)}, http.StatusUnauthorized, ""},
+		{"empty secret", map[string]string{"X-Unset-Signature": sign("", body)}, http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestContext(t, body, tt.headers)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, c.Request)
+			if w.Code != tt.want {
+				t.Fatalf("Unexpected status: got %d, want %d", w.Code, tt.want)
+			}
+			if tt.keyID != "" && w.Body.String() != tt.keyID {
+				t.Fatalf("Unexpected key id: got %q, want %q", w.Body.String(), tt.keyID)
+			}
+		})
+	}
+}
+
+func TestSecretValidationPolicy(t *testing.T) {
+	r := NewSignatureRegistry()
+	if err := r.Register(GenericSignature("policy", HeaderGeneric, StaticSecret("secret"))); err != nil {
+		t.Fatalf("Failed to register signature: %s", err)
+	}
+	body := []byte(`{"event":"deploy"}`)
+
+	tests := []struct {
+		policy ValidationPolicy
+		want   int
+		result string
+	}{
+		{PolicyEnforce, http.StatusUnauthorized, resultFailed},
+		{PolicyLogOnly, http.StatusOK, resultFailed},
+		{PolicyDisabled, http.StatusOK, resultSkipped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			policy, err := ParseValidationPolicy(tt.policy.String())
+			if err != nil || policy != tt.policy {
+				t.Fatalf("Failed to parse policy: %v, %v", policy, err)
+			}
+			promRegistry := prometheus.NewRegistry()
+			metrics, err := NewValidationMetrics(metric.NewRegistry(metric.Config{
+				Namespace: "my-project", Registerer: promRegistry, Gatherer: promRegistry,
+			}))
+			if err != nil {
+				t.Fatalf("Failed to register metrics: %s", err)
+			}
+
+			router := gin.New()
+			router.POST("/webhook", r.SecretValidation(WithPolicy(tt.policy), WithValidationMetrics(metrics)), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+			c := newTestContext(t, body, map[string]string{HeaderGeneric: sign("wrong", body)})
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, c.Request)
+			if w.Code != tt.want {
+				t.Fatalf("Unexpected status: got %d, want %d", w.Code, tt.want)
+			}
+			counter := metrics.validations.WithLabelValues("policy", tt.result)
+			if got := testutil.ToFloat64(counter); got != 1 {
+				t.Fatalf("Unexpected %s count: %v", tt.result, got)
+			}
+			if n, err := testutil.GatherAndCount(promRegistry, "my_project_webhook_validations_total"); err != nil || n != 1 {
+				t.Fatalf("Unexpected series: %d %v", n, err)
+			}
+		})
+	}
+
+	if _, err := ParseValidationPolicy("sometimes"); !errors.Is(err, ErrParsePolicy) {
+		t.Fatalf("Expected parse error, got %v", err)
+	}
+}
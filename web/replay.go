@@ -0,0 +1,265 @@
+// replay protection for webhook deliveries
+package web
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// DefaultReplayTTL is how long a delivery id is remembered, github may
+	// retry or redeliver a delivery hours after it was first sent
+	DefaultReplayTTL = 24 * time.Hour
+	// DefaultReplayMaxEntries bounds the in-memory replay store
+	DefaultReplayMaxEntries = 100_000
+	// ReplayTolerance is how old a delivery timestamp may be when the provider sends one
+	ReplayTolerance = 5 * time.Minute
+)
+
+// errors
+var (
+	ErrReplayedDelivery = errors.New("webhook delivery already processed")
+	ErrStaleDelivery    = errors.New("webhook delivery timestamp outside tolerance")
+)
+
+var (
+	replayBucket = []byte("webhook_deliveries")
+	expiryBucket = []byte("webhook_delivery_expiry")
+)
+
+// Delivery identifies a single webhook delivery
+type Delivery struct {
+	ID string
+	// Timestamp is when the provider sent the delivery, zero if unknown
+	Timestamp time.Time
+}
+
+// ReplayStore records webhook deliveries that have been processed
+type ReplayStore interface {
+	// Seen records the key and reports whether it was already recorded
+	Seen(key string) (bool, error)
+	// Forget removes the key so a redelivery is processed again
+	Forget(key string) error
+}
+
+// WebhookReplayProtection is a middleware rejecting webhook deliveries that
+// were already processed, it should run after WebhookSecretValidation so only
+// verified deliveries are recorded
+func WebhookReplayProtection(store ReplayStore, opts ...Signature) gin.HandlerFunc {
+	if opts == nil {
+		return DefaultSignatureRegistry().ReplayProtection(store)
+	}
+
+	return (&SignatureRegistry{signatures: opts}).ReplayProtection(store)
+}
+
+// checkDelivery enforces the timestamp tolerance and records the delivery,
+// returning the store key or an empty key for deliveries without an id
+func checkDelivery(store ReplayStore, header string, delivery Delivery) (string, error) {
+	if !delivery.Timestamp.IsZero() {
+		if age := timeNow().Sub(delivery.Timestamp); age > ReplayTolerance || age < -ReplayTolerance {
+			return "", fmt.Errorf("%w: %s", ErrStaleDelivery, delivery.Timestamp)
+		}
+	}
+	if delivery.ID == "" {
+		return "", nil
+	}
+	key := header + ":" + delivery.ID
+	seen, err := store.Seen(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to check webhook delivery: %w", err)
+	}
+	if seen {
+		return "", fmt.Errorf("%w: %s", ErrReplayedDelivery, delivery.ID)
+	}
+
+	return key, nil
+}
+
+// releaseDelivery is deferred around the handler and forgets the delivery when
+// the handler panics or doesn't succeed, so the provider's redelivery is
+// processed instead of rejected as a replay
+func releaseDelivery(c *gin.Context, store ReplayStore, key string) {
+	p := recover()
+	if status := c.Writer.Status(); p != nil || status < 200 || status > 299 {
+		if err := store.Forget(key); err != nil {
+			Log(c).WithField("delivery", key).Errorf("failed to forget webhook delivery: %s", err)
+		}
+	}
+	if p != nil {
+		panic(p)
+	}
+}
+
+// IsReplayed checks if err is a replayed delivery and aborts with json 409 error
+func IsReplayed(c *gin.Context, err error) bool {
+	if errors.Is(err, ErrReplayedDelivery) {
+		Abort(c, err)
+
+		return true
+	}
+
+	return false
+}
+
+// MemoryReplayStore is an in-memory ReplayStore bounded by ttl and size
+type MemoryReplayStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type replayEntry struct {
+	key     string
+	expires time.Time
+}
+
+// NewMemoryReplayStore creates an in-memory replay store remembering at most
+// max deliveries for ttl each
+func NewMemoryReplayStore(ttl time.Duration, max int) *MemoryReplayStore {
+	if max <= 0 {
+		max = DefaultReplayMaxEntries
+	}
+
+	return &MemoryReplayStore{
+		ttl:     ttl,
+		max:     max,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Seen records the key and reports whether it was already recorded
+func (s *MemoryReplayStore) Seen(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := timeNow()
+	// entries share a ttl so insertion order is expiry order
+	for e := s.order.Front(); e != nil; e = s.order.Front() {
+		entry := e.Value.(replayEntry)
+		if now.Before(entry.expires) && s.order.Len() < s.max {
+			break
+		}
+		s.order.Remove(e)
+		delete(s.entries, entry.key)
+	}
+
+	if _, ok := s.entries[key]; ok {
+		return true, nil
+	}
+	s.entries[key] = s.order.PushBack(replayEntry{key: key, expires: now.Add(s.ttl)})
+
+	return false, nil
+}
+
+// Forget removes the key so a redelivery is processed again
+func (s *MemoryReplayStore) Forget(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		s.order.Remove(e)
+		delete(s.entries, key)
+	}
+
+	return nil
+}
+
+// BoltReplayStore is a ReplayStore persisted in a bbolt database
+type BoltReplayStore struct {
+	db  *bolt.DB
+	ttl time.Duration
+}
+
+// NewBoltReplayStore creates a replay store in db remembering deliveries for ttl
+func NewBoltReplayStore(db *bolt.DB, ttl time.Duration) (*BoltReplayStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(replayBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(expiryBucket)
+
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replay buckets: %w", err)
+	}
+
+	return &BoltReplayStore{db: db, ttl: ttl}, nil
+}
+
+// Seen records the key and reports whether it was already recorded
+func (s *BoltReplayStore) Seen(key string) (bool, error) {
+	seen := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		deliveries := tx.Bucket(replayBucket)
+		expiry := tx.Bucket(expiryBucket)
+		now := timeNow()
+
+		// expiry keys are prefixed with a big endian timestamp so the
+		// cursor walks them oldest first
+		var expired [][]byte
+		cur := expiry.Cursor()
+		for k, _ := cur.First(); k != nil && int64(binary.BigEndian.Uint64(k)) <= now.UnixNano(); k, _ = cur.Next() {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		for _, k := range expired {
+			if err := deliveries.Delete(k[8:]); err != nil {
+				return err
+			}
+			if err := expiry.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		if deliveries.Get([]byte(key)) != nil {
+			seen = true
+			return nil
+		}
+		expires := make([]byte, 8, 8+len(key))
+		binary.BigEndian.PutUint64(expires, uint64(now.Add(s.ttl).UnixNano()))
+		expires = append(expires, key...)
+		if err := deliveries.Put([]byte(key), expires[:8]); err != nil {
+			return err
+		}
+
+		return expiry.Put(expires, []byte(key))
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to record delivery: %w", err)
+	}
+
+	return seen, nil
+}
+
+// Forget removes the key so a redelivery is processed again
+func (s *BoltReplayStore) Forget(key string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		deliveries := tx.Bucket(replayBucket)
+		expires := deliveries.Get([]byte(key))
+		if expires == nil {
+			return nil
+		}
+		expiryKey := append(append([]byte(nil), expires...), key...)
+		if err := tx.Bucket(expiryBucket).Delete(expiryKey); err != nil {
+			return err
+		}
+
+		return deliveries.Delete([]byte(key))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to forget delivery: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+func testReplayStore(t *testing.T, store ReplayStore) {
+	t.Helper()
+	now := time.Unix(1651406400, 0)
+	fixedNow(t, now)
+
+	if seen, err := store.Seen("a"); err != nil || seen {
+		t.Fatalf("First delivery reported as seen: %v, %v", seen, err)
+	}
+	if seen, err := store.Seen("a"); err != nil || !seen {
+		t.Fatalf("Replayed delivery not detected: %v, %v", seen, err)
+	}
+	if seen, err := store.Seen("b"); err != nil || seen {
+		t.Fatalf("Distinct delivery reported as seen: %v, %v", seen, err)
+	}
+	if err := store.Forget("b"); err != nil {
+		t.Fatalf("Failed to forget delivery: %s", err)
+	}
+	if seen, err := store.Seen("b"); err != nil || seen {
+		t.Fatalf("Forgotten delivery reported as seen: %v, %v", seen, err)
+	}
+
+	fixedNow(t, now.Add(2*time.Hour))
+	if seen, err := store.Seen("a"); err != nil || seen {
+		t.Fatalf("Expired delivery reported as seen: %v, %v", seen, err)
+	}
+}
+
+func TestMemoryReplayStore(t *testing.T) {
+	testReplayStore(t, NewMemoryReplayStore(time.Hour, 10))
+}
+
+func TestMemoryReplayStoreBounded(t *testing.T) {
+	fixedNow(t, time.Unix(1651406400, 0))
+	store := NewMemoryReplayStore(time.Hour, 2)
+	for i := 0; i < 3; i++ {
+		if _, err := store.Seen(strconv.Itoa(i)); err != nil {
+			t.Fatalf("Failed to record delivery: %s", err)
+		}
+	}
+	if seen, _ := store.Seen("0"); seen {
+		t.Fatalf("Oldest delivery was not evicted")
+	}
+	if len(store.entries) > 2 {
+		t.Fatalf("Store grew beyond its bound: %d", len(store.entries))
+	}
+}
+
+func TestBoltReplayStore(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "replay.db"), 0o600, nil)
+	if err != nil {
+		t.Fatalf("Failed to open bolt db: %s", err)
+	}
+	defer db.Close()
+
+	store, err := NewBoltReplayStore(db, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+	testReplayStore(t, store)
+}
+
+func TestWebhookReplayProtection(t *testing.T) {
+	now := time.Unix(1651406400, 0)
+	fixedNow(t, now)
+
+	router := gin.New()
+	router.POST("/webhook", WebhookReplayProtection(NewMemoryReplayStore(time.Hour, 10)), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	slackTimestamp := strconv.FormatInt(now.Unix(), 10)
+	staleTimestamp := strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"github", map[string]string{HeaderGithub: "sha256=00", HeaderGithubDelivery: "1"}, http.StatusOK},
+		{"github replayed", map[string]string{HeaderGithub: "sha256=00", HeaderGithubDelivery: "1"}, http.StatusConflict},
+		{"slack", map[string]string{HeaderSlack: "v0=00", HeaderSlackTimestamp: slackTimestamp}, http.StatusOK},
+		{"slack replayed", map[string]string{HeaderSlack: "v0=00", HeaderSlackTimestamp: slackTimestamp}, http.StatusConflict},
+		{"slack stale", map[string]string{HeaderSlack: "v0=01", HeaderSlackTimestamp: staleTimestamp}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestContext(t, []byte("{}"), tt.headers)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, c.Request)
+			if w.Code != tt.want {
+				t.Fatalf("Unexpected status: got %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckDelivery(t *testing.T) {
+	fixedNow(t, time.Unix(1651406400, 0))
+	store := NewMemoryReplayStore(time.Hour, 10)
+
+	if key, err := checkDelivery(store, HeaderLinear, Delivery{}); err != nil || key != "" {
+		t.Fatalf("Deliveries without an id should pass: %q, %v", key, err)
+	}
+	if key, err := checkDelivery(store, HeaderLinear, Delivery{ID: "x"}); err != nil || key != HeaderLinear+":x" {
+		t.Fatalf("Unexpected result: %q, %v", key, err)
+	}
+	if _, err := checkDelivery(store, HeaderLinear, Delivery{ID: "x"}); !errors.Is(err, ErrReplayedDelivery) {
+		t.Fatalf("Expected replayed delivery, got %v", err)
+	}
+}
+
+// failingReplayStore fails every call
+type failingReplayStore struct{}
+
+func (failingReplayStore) Seen(string) (bool, error) { return false, bolt.ErrDatabaseNotOpen }
+func (failingReplayStore) Forget(string) error       { return bolt.ErrDatabaseNotOpen }
+
+func TestWebhookReplayProtectionFailures(t *testing.T) {
+	fixedNow(t, time.Unix(1651406400, 0))
+	headers := map[string]string{HeaderGithub: "sha256=00", HeaderGithubDelivery: "1"}
+	status := http.StatusInternalServerError
+
+	router := gin.New()
+	router.Use(gin.CustomRecovery(func(c *gin.Context, _ interface{}) {
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}))
+	router.POST("/webhook", WebhookReplayProtection(NewMemoryReplayStore(time.Hour, 10)), func(c *gin.Context) {
+		if status == 0 {
+			panic("handler failed")
+		}
+		c.Status(status)
+	})
+	router.POST("/broken", WebhookReplayProtection(failingReplayStore{}), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		name    string
+		path    string
+		handler int
+		want    int
+	}{
+		{"handler error", "/webhook", http.StatusInternalServerError, http.StatusInternalServerError},
+		{"handler panic", "/webhook", 0, http.StatusInternalServerError},
+		{"redelivery after failures", "/webhook", http.StatusOK, http.StatusOK},
+		{"replayed after success", "/webhook", http.StatusOK, http.StatusConflict},
+		{"store error", "/broken", http.StatusOK, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status = tt.handler
+			c := newTestContext(t, []byte("{}"), headers)
+			c.Request.URL.Path = tt.path
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, c.Request)
+			if w.Code != tt.want {
+				t.Fatalf("Unexpected status: got %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+// request ids and request scoped logging
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/threecommaio/opc/core/requestid"
+)
+
+const (
+	// HeaderRequestID is accepted from clients and returned on every response
+	HeaderRequestID = requestid.Header
+
+	// ContextKeyRequestID is the gin context key holding the request id
+	ContextKeyRequestID = "web.request_id"
+
+	accessTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// RequestID accepts a valid X-Request-ID or generates one, returns it on the
+// response and stores it in the request context, where Log, the access log and
+// requestid.Transport pick it up
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(HeaderRequestID)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+		}
+
+		c.Set(ContextKeyRequestID, id)
+		c.Header(HeaderRequestID, id)
+		c.Request = c.Request.WithContext(requestid.NewContext(c.Request.Context(), id))
+
+		c.Next()
+	}
+}
+
+// RequestIDFrom returns the id set by RequestID
+func RequestIDFrom(c *gin.Context) string {
+	return c.GetString(ContextKeyRequestID)
+}
+
+// Log returns a logger for the request, entries carry the request id
+func Log(c *gin.Context) *log.Entry {
+	entry := log.WithContext(c.Request.Context())
+	if id := RequestIDFrom(c); id != "" {
+		entry = entry.WithField(requestid.Field, id)
+	}
+
+	return entry
+}
+
+// AccessLogger logs each request in the format of ginlogrus.Logger with the
+// request id, place it after RequestID
+func AccessLogger() gin.HandlerFunc {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return func(c *gin.Context) {
+		// other handlers can change c.Request.URL.Path
+		path := c.Request.URL.Path
+		start := time.Now()
+		c.Next()
+		latency := time.Since(start).Milliseconds()
+
+		statusCode := c.Writer.Status()
+		clientIP := c.ClientIP()
+		dataLength := c.Writer.Size()
+		if dataLength < 0 {
+			dataLength = 0
+		}
+
+		entry := Log(c).WithFields(log.Fields{
+			"hostname":   hostname,
+			"statusCode": statusCode,
+			"latency":    latency,
+			"clientIP":   clientIP,
+			"method":     c.Request.Method,
+			"path":       path,
+			"referer":    c.Request.Referer(),
+			"dataLength": dataLength,
+			"userAgent":  c.Request.UserAgent(),
+		})
+
+		if len(c.Errors) > 0 {
+			entry.Error(c.Errors.ByType(gin.ErrorTypePrivate).String())
+			return
+		}
+		msg := fmt.Sprintf("%s - %s [%s] \"%s %s\" %d %d \"%s\" \"%s\" (%dms)", clientIP, hostname,
+			time.Now().Format(accessTimeFormat), c.Request.Method, path, statusCode, dataLength,
+			c.Request.Referer(), c.Request.UserAgent(), latency)
+		switch {
+		case statusCode >= http.StatusInternalServerError:
+			entry.Error(msg)
+		case statusCode >= http.StatusBadRequest:
+			entry.Warn(msg)
+		default:
+			entry.Info(msg)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package web
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/threecommaio/opc/core/requestid"
+)
+
+func TestRequestID(t *testing.T) {
+	var outbound string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		outbound = r.Header.Get(HeaderRequestID)
+	}))
+	defer upstream.Close()
+
+	var buf bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+
+	router := gin.New()
+	router.Use(RequestID(), AccessLogger())
+	router.GET("/call", func(c *gin.Context) {
+		req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, upstream.URL, nil)
+		if IsError(c, err) {
+			return
+		}
+		resp, err := requestid.Client.Do(req)
+		if IsError(c, err) {
+			return
+		}
+		resp.Body.Close()
+		Log(c).Info("called upstream")
+		c.String(http.StatusOK, RequestIDFrom(c))
+	})
+
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{"accepted", "upstream-id-1", true},
+		{"generated", "", false},
+		{"invalid replaced", "bad id\r\nforged: 1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			req := httptest.NewRequest(http.MethodGet, "/call", nil)
+			if tt.incoming != "" {
+				req.Header.Set(HeaderRequestID, tt.incoming)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			id := w.Header().Get(HeaderRequestID)
+			if !requestid.Valid(id) || (tt.keep && id != tt.incoming) || (!tt.keep && id == tt.incoming) {
+				t.Fatalf("Unexpected request id %q for %q", id, tt.incoming)
+			}
+			if w.Body.String() != id || outbound != id {
+				t.Fatalf("Request id not propagated: body %q, outbound %q, want %q", w.Body.String(), outbound, id)
+			}
+			if n := strings.Count(buf.String(), "request_id="+id); n != 2 {
+				t.Fatalf("Expected the handler and access log entries to carry the id, got %d: %s", n, buf.String())
+			}
+		})
+	}
+}
+
+func TestWebhookLogsCarryRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+
+	router := gin.New()
+	router.Use(RequestID())
+	router.POST("/webhook", DefaultSignatureRegistry().SecretValidation(WithPolicy(PolicyLogOnly)), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader("{}"))
+	req.Header.Set(HeaderRequestID, "webhook-id-1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if !strings.Contains(buf.String(), "webhook validation failed") || !strings.Contains(buf.String(), "request_id=webhook-id-1") {
+		t.Fatalf("Expected the validation failure to carry the request id: %s", buf.String())
+	}
+}
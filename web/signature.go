@@ -1,36 +1,94 @@
 package web
 
 import (
+	stdhmac "crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/go-github/v43/github"
 	"github.com/slack-go/slack"
 	"github.com/slack-go/slack/slackevents"
+
+	"github.com/threecommaio/opc/core/hmac"
 )
 
 const (
-	HeaderSlack  = "X-Slack-Signature"
-	HeaderGithub = "X-Hub-Signature-256"
-	HeaderLinear = "Linear-Delivery"
+	HeaderSlack           = "X-Slack-Signature"
+	HeaderGithub          = "X-Hub-Signature-256"
+	HeaderLinear          = "Linear-Delivery"
+	HeaderLinearSignature = "Linear-Signature"
+
+	HeaderSlackTimestamp = "X-Slack-Request-Timestamp"
+	HeaderGithubDelivery = "X-GitHub-Delivery"
+	HeaderPagerDuty      = "X-PagerDuty-Signature"
+	HeaderGeneric        = "X-Signature"
+
+	HeaderStripe           = "Stripe-Signature"
+	HeaderTwilio           = "X-Twilio-Signature"
+	HeaderTwilioDelivery   = "I-Twilio-Idempotency-Token"
+	HeaderShopify          = "X-Shopify-Hmac-Sha256"
+	HeaderShopifyDelivery  = "X-Shopify-Webhook-Id"
+	HeaderShopifyTriggered = "X-Shopify-Triggered-At"
+
+	HeaderWebhookTimestamp = "X-Webhook-Timestamp"
+	HeaderWebhookDelivery  = "X-Webhook-Delivery"
+
+	// StripeTimestampTolerance is how old a stripe signature timestamp may be
+	StripeTimestampTolerance = 5 * time.Minute
+
+	// LinearTimestampTolerance is how old a linear webhookTimestamp may be
+	LinearTimestampTolerance = time.Minute
+
+	// WebhookTimestampTolerance is how old a package webhook timestamp may be
+	WebhookTimestampTolerance = 5 * time.Minute
 )
 
 var (
-	ErrVerifyingSlack  = errors.New("error verifying slack secret")
-	ErrVerifyingGithub = errors.New("error verifying github secret")
+	ErrVerifyingSlack   = errors.New("error verifying slack secret")
+	ErrVerifyingGithub  = errors.New("error verifying github secret")
+	ErrVerifyingLinear  = errors.New("error verifying linear secret")
+	ErrVerifyingPD      = errors.New("error verifying pagerduty secret")
+	ErrVerifying        = errors.New("error verifying webhook secret")
+	ErrVerifyingStripe  = errors.New("error verifying stripe secret")
+	ErrVerifyingTwilio  = errors.New("error verifying twilio secret")
+	ErrVerifyingShop    = errors.New("error verifying shopify secret")
+	ErrStripeTimestamp  = errors.New("stripe signature timestamp outside tolerance")
+	ErrLinearTimestamp  = errors.New("linear webhook timestamp outside tolerance")
+	ErrWebhookTimestamp = errors.New("webhook timestamp outside tolerance")
+	ErrIPNotAllowed     = errors.New("client ip not allowed")
 )
 
+// timeNow is overridden in tests to validate fixtures with fixed timestamps
+var timeNow = time.Now
+
+// Signature describes how a webhook provider signs its deliveries
 type Signature struct {
-	Header  string
-	Env     string
+	Name   string
+	Header string
+	Env    string
+	// Secret resolves the secret, nil reads it from Env
+	Secret  SecretResolver
 	IsValid func(c *gin.Context, data []byte, secret string) error
+	// Delivery identifies the delivery for replay protection, nil disables it
+	Delivery func(c *gin.Context, data []byte) (Delivery, error)
 }
 
+// Challenge describes how a webhook provider verifies a new endpoint
 type Challenge struct {
-	Header  string
-	Env     string
+	Header string
+	Env    string
+	// Secret resolves the secret, nil reads it from Env
+	Secret  SecretResolver
 	IsValid func(c *gin.Context, data []byte, secret string) error
 }
 
@@ -85,9 +143,337 @@ func GithubValidator(c *gin.Context, data []byte, secret string) error {
 	return nil
 }
 
+// SlackDelivery identifies a slack delivery by its timestamp and signature
+func SlackDelivery(c *gin.Context, data []byte) (Delivery, error) {
+	ts := c.Request.Header.Get(HeaderSlackTimestamp)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return Delivery{}, fmt.Errorf("%w: invalid timestamp %q", ErrVerifyingSlack, ts)
+	}
+
+	return Delivery{
+		ID:        ts + ":" + c.Request.Header.Get(HeaderSlack),
+		Timestamp: time.Unix(sec, 0),
+	}, nil
+}
+
+// GithubDelivery identifies a github delivery by its guid
+func GithubDelivery(c *gin.Context, data []byte) (Delivery, error) {
+	return Delivery{ID: c.Request.Header.Get(HeaderGithubDelivery)}, nil
+}
+
+// LinearDelivery identifies a linear delivery by its id and webhookTimestamp
+func LinearDelivery(c *gin.Context, data []byte) (Delivery, error) {
+	var payload struct {
+		WebhookTimestamp int64 `json:"webhookTimestamp"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return Delivery{}, fmt.Errorf("%w: %s", ErrVerifyingLinear, err)
+	}
+
+	return Delivery{
+		ID:        c.Request.Header.Get(HeaderLinear),
+		Timestamp: time.UnixMilli(payload.WebhookTimestamp),
+	}, nil
+}
+
+// LinearOptions configures the linear webhook validator
+type LinearOptions struct {
+	// Tolerance is the allowed age of webhookTimestamp, defaults to LinearTimestampTolerance
+	Tolerance time.Duration
+	// AllowedCIDRs restricts deliveries to the given networks when not empty,
+	// matched against c.ClientIP() so set WithTrustedProxies to keep clients
+	// from choosing their address with X-Forwarded-For
+	AllowedCIDRs []string
+}
+
 // LinearValidator validates linear webhook signature
 func LinearValidator(c *gin.Context, data []byte, secret string) error {
-	// TODO: add ip allowlist here
-	// no verification required due to linear lacking signature verification
+	return linearValidator{tolerance: LinearTimestampTolerance}.validate(c, data, secret)
+}
+
+// NewLinearValidator returns a linear validator with a custom tolerance and ip allowlist
+func NewLinearValidator(opts LinearOptions) (func(c *gin.Context, data []byte, secret string) error, error) {
+	v := linearValidator{tolerance: opts.Tolerance}
+	if v.tolerance == 0 {
+		v.tolerance = LinearTimestampTolerance
+	}
+	for _, cidr := range opts.AllowedCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse linear allowed cidr: %w", err)
+		}
+		v.allowed = append(v.allowed, network)
+	}
+
+	return v.validate, nil
+}
+
+type linearValidator struct {
+	tolerance time.Duration
+	allowed   []*net.IPNet
+}
+
+func (v linearValidator) validate(c *gin.Context, data []byte, secret string) error {
+	if len(v.allowed) > 0 {
+		if ip := net.ParseIP(c.ClientIP()); !inNetworks(v.allowed, ip) {
+			return fmt.Errorf("%w: %s", ErrIPNotAllowed, ip)
+		}
+	}
+
+	signature := c.Request.Header.Get(HeaderLinearSignature)
+	if err := hmac.Linear.Validate(signature, data, []byte(secret)); err != nil {
+		return fmt.Errorf("%w: %s", ErrVerifyingLinear, err)
+	}
+
+	var payload struct {
+		WebhookTimestamp int64 `json:"webhookTimestamp"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return fmt.Errorf("%w: %s", ErrVerifyingLinear, err)
+	}
+	sent := time.UnixMilli(payload.WebhookTimestamp)
+	if age := timeNow().Sub(sent); age > v.tolerance || age < -v.tolerance {
+		return fmt.Errorf("%w: %s", ErrLinearTimestamp, sent)
+	}
+
+	return nil
+}
+
+// inNetworks reports whether ip is in any of networks
+func inNetworks(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PagerDutySignature creates a provider for pagerduty v3 webhooks
+func PagerDutySignature(secret SecretResolver) Signature {
+	return Signature{Name: "pagerduty", Header: HeaderPagerDuty, Secret: secret, IsValid: PagerDutyValidator}
+}
+
+// PagerDutyValidator validates pagerduty webhook signature, the header holds a
+// comma separated list of v1 signatures, one per active secret
+func PagerDutyValidator(c *gin.Context, data []byte, secret string) error {
+	var err error
+	for _, signature := range strings.Split(c.Request.Header.Get(HeaderPagerDuty), ",") {
+		err = hmac.ValidateSignature("v1", strings.TrimSpace(signature), data, []byte(secret))
+		if err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrVerifyingPD, err)
+}
+
+// GenericSignature creates a provider for in-house senders that sign the body
+// with hmac sha256 and send it as `sha256=<hex>` in header
+func GenericSignature(name, header string, secret SecretResolver) Signature {
+	return Signature{Name: name, Header: header, Secret: secret, IsValid: GenericValidator(header)}
+}
+
+// GenericValidator validates a `sha256=<hex>` signature sent in header
+func GenericValidator(header string) func(c *gin.Context, data []byte, secret string) error {
+	return func(c *gin.Context, data []byte, secret string) error {
+		signature := c.Request.Header.Get(header)
+		if err := hmac.ValidateSignature("sha256", signature, data, []byte(secret)); err != nil {
+			return fmt.Errorf("%w: %s", ErrVerifying, err)
+		}
+
+		return nil
+	}
+}
+
+// WebhookSignature creates a provider for deliveries sent by package webhook,
+// the `sha256=<hex>` signature covers the timestamp and body
+func WebhookSignature(name string, secret SecretResolver) Signature {
+	return Signature{Name: name, Header: HeaderGeneric, Secret: secret, IsValid: WebhookValidator, Delivery: WebhookDelivery}
+}
+
+// WebhookValidator validates a package webhook signature and rejects
+// timestamps outside WebhookTimestampTolerance
+func WebhookValidator(c *gin.Context, data []byte, secret string) error {
+	timestamp := c.Request.Header.Get(HeaderWebhookTimestamp)
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp %q", ErrVerifying, timestamp)
+	}
+	if age := timeNow().Sub(time.Unix(sec, 0)); age > WebhookTimestampTolerance || age < -WebhookTimestampTolerance {
+		return fmt.Errorf("%w: %s", ErrWebhookTimestamp, time.Unix(sec, 0))
+	}
+
+	signature := c.Request.Header.Get(HeaderGeneric)
+	if err := hmac.Webhook.Validate(signature, data, []byte(secret), timestamp); err != nil {
+		return fmt.Errorf("%w: %s", ErrVerifying, err)
+	}
+
+	return nil
+}
+
+// WebhookDelivery identifies a package webhook delivery by its id and timestamp
+func WebhookDelivery(c *gin.Context, data []byte) (Delivery, error) {
+	timestamp := c.Request.Header.Get(HeaderWebhookTimestamp)
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return Delivery{}, fmt.Errorf("%w: invalid timestamp %q", ErrVerifying, timestamp)
+	}
+
+	return Delivery{ID: c.Request.Header.Get(HeaderWebhookDelivery), Timestamp: time.Unix(sec, 0)}, nil
+}
+
+// stripeHeader splits a stripe signature header into its timestamp and v1 signatures
+func stripeHeader(header string) (string, []string) {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		switch {
+		case strings.HasPrefix(part, "t="):
+			timestamp = strings.TrimPrefix(part, "t=")
+		case strings.HasPrefix(part, "v1="):
+			signatures = append(signatures, part)
+		}
+	}
+
+	return timestamp, signatures
+}
+
+// StripeValidator validates stripe webhook signature, the signed payload is
+// the timestamp and body joined by a dot and any v1 signature may match
+func StripeValidator(c *gin.Context, data []byte, secret string) error {
+	timestamp, signatures := stripeHeader(c.Request.Header.Get(HeaderStripe))
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp %q", ErrVerifyingStripe, timestamp)
+	}
+	if age := timeNow().Sub(time.Unix(sec, 0)); age > StripeTimestampTolerance || age < -StripeTimestampTolerance {
+		return fmt.Errorf("%w: %s", ErrStripeTimestamp, time.Unix(sec, 0))
+	}
+	if len(signatures) == 0 {
+		return fmt.Errorf("%w: %s", ErrVerifyingStripe, ErrNoSignature)
+	}
+
+	for _, signature := range signatures {
+		err = hmac.Stripe.Validate(signature, data, []byte(secret), timestamp)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrVerifyingStripe, err)
+}
+
+// StripeDelivery identifies a stripe delivery by its event id and timestamp
+func StripeDelivery(c *gin.Context, data []byte) (Delivery, error) {
+	var event struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return Delivery{}, fmt.Errorf("%w: %s", ErrVerifyingStripe, err)
+	}
+	timestamp, _ := stripeHeader(c.Request.Header.Get(HeaderStripe))
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return Delivery{}, fmt.Errorf("%w: invalid timestamp %q", ErrVerifyingStripe, timestamp)
+	}
+
+	return Delivery{ID: event.ID, Timestamp: time.Unix(sec, 0)}, nil
+}
+
+// TwilioValidator validates twilio webhook signature, a base64 hmac sha1 over
+// the full request url followed by the sorted form parameters. JSON requests
+// are signed over the url alone and carry the body hash in bodySHA256
+func TwilioValidator(c *gin.Context, data []byte, secret string) error {
+	base := requestURL(c)
+	if bodyHash := c.Request.URL.Query().Get("bodySHA256"); bodyHash != "" {
+		sum := sha256.Sum256(data)
+		if !stdhmac.Equal([]byte(hex.EncodeToString(sum[:])), []byte(bodyHash)) {
+			return fmt.Errorf("%w: body hash mismatch", ErrVerifyingTwilio)
+		}
+	} else {
+		params, err := url.ParseQuery(string(data))
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrVerifyingTwilio, err)
+		}
+		base += sortedParams(params)
+	}
+
+	signature := c.Request.Header.Get(HeaderTwilio)
+	if err := hmac.Twilio.Validate(signature, []byte(base), []byte(secret)); err != nil {
+		return fmt.Errorf("%w: %s", ErrVerifyingTwilio, err)
+	}
+
+	return nil
+}
+
+// TwilioDelivery identifies a twilio delivery by its idempotency token
+func TwilioDelivery(c *gin.Context, data []byte) (Delivery, error) {
+	return Delivery{ID: c.Request.Header.Get(HeaderTwilioDelivery)}, nil
+}
+
+// requestURL rebuilds the url the sender used, honoring proxy headers
+func requestURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	// only a trusted proxy knows the scheme the sender used
+	if proto := c.Request.Header.Get("X-Forwarded-Proto"); proto != "" {
+		if _, trusted := c.RemoteIP(); trusted {
+			scheme = proto
+		}
+	}
+
+	return scheme + "://" + c.Request.Host + c.Request.URL.RequestURI()
+}
+
+// sortedParams concatenates each parameter name and value sorted by name
+func sortedParams(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		values := append([]string(nil), params[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			b.WriteString(k)
+			b.WriteString(v)
+		}
+	}
+
+	return b.String()
+}
+
+// ShopifyValidator validates shopify webhook signature, a base64 hmac sha256 of the body
+func ShopifyValidator(c *gin.Context, data []byte, secret string) error {
+	signature := c.Request.Header.Get(HeaderShopify)
+	if err := hmac.Shopify.Validate(signature, data, []byte(secret)); err != nil {
+		return fmt.Errorf("%w: %s", ErrVerifyingShop, err)
+	}
+
 	return nil
 }
+
+// ShopifyDelivery identifies a shopify delivery by its webhook id and trigger time
+func ShopifyDelivery(c *gin.Context, data []byte) (Delivery, error) {
+	delivery := Delivery{ID: c.Request.Header.Get(HeaderShopifyDelivery)}
+	if triggered := c.Request.Header.Get(HeaderShopifyTriggered); triggered != "" {
+		ts, err := time.Parse(time.RFC3339Nano, triggered)
+		if err != nil {
+			return Delivery{}, fmt.Errorf("%w: invalid trigger time %q", ErrVerifyingShop, triggered)
+		}
+		delivery.Timestamp = ts
+	}
+
+	return delivery, nil
+}
@@ -0,0 +1,298 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/threecommaio/opc/core/hmac"
+)
+
+const (
+	linearFixture   = "testdata/linear_issue_create.json"
+	linearSecret    = "linear-secret"
+	linearSignature = "4aef6c09bf1929b1c6831eb673c46bc8ff93dae085bd4c255fdc11e05853434b"
+)
+
+// fixedNow pins timeNow for the duration of the test
+func fixedNow(t *testing.T, now time.Time) {
+	t.Helper()
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+}
+
+// newTestContext creates a gin context for a webhook delivery with the given headers
+func newTestContext(t *testing.T, body []byte, headers map[string]string) *gin.Context {
+	t.Helper()
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+	req.RemoteAddr = "35.231.147.226:443"
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	c.Request = req
+
+	return c
+}
+
+func TestLinearValidator(t *testing.T) {
+	data, err := os.ReadFile(linearFixture)
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %s", err)
+	}
+	sent := time.UnixMilli(1651406400000)
+
+	tests := []struct {
+		name      string
+		signature string
+		secret    string
+		now       time.Time
+		want      error
+	}{
+		{"valid", linearSignature, linearSecret, sent.Add(30 * time.Second), nil},
+		{"wrong secret", linearSignature, "other-secret", sent, ErrVerifyingLinear},
+		{"missing signature", "", linearSecret, sent, ErrVerifyingLinear},
+		{"malformed signature", "not-hex", linearSecret, sent, ErrVerifyingLinear},
+		{"stale timestamp", linearSignature, linearSecret, sent.Add(2 * time.Minute), ErrLinearTimestamp},
+		{"future timestamp", linearSignature, linearSecret, sent.Add(-2 * time.Minute), ErrLinearTimestamp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixedNow(t, tt.now)
+			c := newTestContext(t, data, map[string]string{
+				HeaderLinear:          "5fd3c6cc-7a4a-4f4a-8d2a-b7f6a5d7a6e1",
+				HeaderLinearSignature: tt.signature,
+			})
+			err := LinearValidator(c, data, tt.secret)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Unexpected error: got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinearValidatorAllowlist(t *testing.T) {
+	data, err := os.ReadFile(linearFixture)
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %s", err)
+	}
+	fixedNow(t, time.UnixMilli(1651406400000))
+
+	if _, err := NewLinearValidator(LinearOptions{AllowedCIDRs: []string{"not-a-cidr"}}); err == nil {
+		t.Fatalf("Expected invalid cidr to fail")
+	}
+
+	tests := []struct {
+		name    string
+		cidr    string
+		proxies []string
+		xff     string
+		want    error
+	}{
+		{"allowed", "35.231.147.0/24", nil, "", nil},
+		{"denied", "10.0.0.0/8", nil, "", ErrIPNotAllowed},
+		{"spoofed forwarded for", "10.0.0.0/8", nil, "10.1.2.3", ErrIPNotAllowed},
+		{"trusted proxy", "10.0.0.0/8", []string{"35.231.147.0/24"}, "10.1.2.3", nil},
+		{"spoofed through trusted proxy", "10.0.0.0/8", []string{"35.231.147.0/24"}, "10.1.2.3, 198.51.100.7", ErrIPNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validate, err := NewLinearValidator(LinearOptions{AllowedCIDRs: []string{tt.cidr}})
+			if err != nil {
+				t.Fatalf("Failed to create validator: %s", err)
+			}
+			// proxies are trusted the way WithTrustedProxies configures them
+			c, engine := gin.CreateTestContext(httptest.NewRecorder())
+			if err := engine.SetTrustedProxies(tt.proxies); err != nil {
+				t.Fatalf("Failed to set trusted proxies: %s", err)
+			}
+			c.Request = newTestContext(t, data, map[string]string{HeaderLinearSignature: linearSignature}).Request
+			if tt.xff != "" {
+				c.Request.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if err := validate(c, data, linearSecret); !errors.Is(err, tt.want) {
+				t.Fatalf("Unexpected error: got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookSecretValidationLinear(t *testing.T) {
+	data, err := os.ReadFile(linearFixture)
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %s", err)
+	}
+	fixedNow(t, time.UnixMilli(1651406400000))
+	t.Setenv(LinearSignature.Env, linearSecret)
+
+	router := gin.New()
+	router.POST("/webhook", WebhookSecretValidation(LinearSignature), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"signed", map[string]string{HeaderLinear: "1", HeaderLinearSignature: linearSignature}, http.StatusOK},
+		{"delivery without signature", map[string]string{HeaderLinear: "1"}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestContext(t, data, tt.headers)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, c.Request)
+			if w.Code != tt.want {
+				t.Fatalf("Unexpected status: got %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+// golden vectors for the providers that sign with their own schemes
+const (
+	stripeSecret    = "whsec_test_secret"
+	stripeBody      = `{"id":"evt_1KtM2a2eZvKYlo2C","object":"event","type":"payment_intent.succeeded"}`
+	stripeSignature = "0a406c5dbedb4387072ca9283f6d1309d85318de2ab07aa1fa3ffcdef9e898b4"
+
+	twilioToken     = "12345"
+	twilioURL       = "https://mycompany.com/myapp.php?foo=1&bar=2"
+	twilioBody      = "CallSid=CA1234567890ABCDE&Caller=%2B12349013030&Digits=1234&From=%2B12349013030&To=%2B18005551212"
+	twilioSignature = "0/KCTR6DLpKmkAf8muzZqo1nDgQ="
+
+	shopifySecret    = "shpss_test_secret"
+	shopifyBody      = `{"id":820982911946154508,"email":"jon@doe.ca","total_price":"403.00"}`
+	shopifySignature = "6JWS1UP7vdSPDLcbJGkuqvRXla4CIucgAjnlxPwYGXE="
+)
+
+func TestStripeValidator(t *testing.T) {
+	sent := time.Unix(1651406400, 0)
+	tests := []struct {
+		name   string
+		header string
+		secret string
+		now    time.Time
+		want   error
+	}{
+		{"valid", "t=1651406400,v1=" + stripeSignature, stripeSecret, sent, nil},
+		{"rotated", "t=1651406400,v1=00ff,v1=" + stripeSignature + ",v0=00", stripeSecret, sent, nil},
+		{"wrong secret", "t=1651406400,v1=" + stripeSignature, "whsec_other", sent, ErrVerifyingStripe},
+		{"no v1", "t=1651406400,v0=" + stripeSignature, stripeSecret, sent, ErrVerifyingStripe},
+		{"no timestamp", "v1=" + stripeSignature, stripeSecret, sent, ErrVerifyingStripe},
+		{"stale", "t=1651406400,v1=" + stripeSignature, stripeSecret, sent.Add(10 * time.Minute), ErrStripeTimestamp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixedNow(t, tt.now)
+			c := newTestContext(t, []byte(stripeBody), map[string]string{HeaderStripe: tt.header})
+			if err := StripeValidator(c, []byte(stripeBody), tt.secret); !errors.Is(err, tt.want) {
+				t.Fatalf("Unexpected error: got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookValidator(t *testing.T) {
+	body := []byte(`{"event":"deploy.finished"}`)
+	sent := time.Unix(1651406400, 0)
+	signature, err := hmac.Sign(hmac.Webhook, body, []byte("outbound-secret"), "1651406400")
+	if err != nil {
+		t.Fatalf("Failed to sign: %s", err)
+	}
+	tests := []struct {
+		name      string
+		timestamp string
+		secret    string
+		now       time.Time
+		want      error
+	}{
+		{"valid", "1651406400", "outbound-secret", sent, nil},
+		{"wrong secret", "1651406400", "other", sent, ErrVerifying},
+		{"timestamp changed", "1651406401", "outbound-secret", sent, ErrVerifying},
+		{"no timestamp", "", "outbound-secret", sent, ErrVerifying},
+		{"stale", "1651406400", "outbound-secret", sent.Add(10 * time.Minute), ErrWebhookTimestamp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixedNow(t, tt.now)
+			c := newTestContext(t, body, map[string]string{
+				HeaderGeneric: signature, HeaderWebhookTimestamp: tt.timestamp, HeaderWebhookDelivery: "msg-1",
+			})
+			if err := WebhookValidator(c, body, tt.secret); !errors.Is(err, tt.want) {
+				t.Fatalf("Unexpected error: got %v, want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				return
+			}
+			delivery, err := WebhookDelivery(c, body)
+			if err != nil || delivery.ID != "msg-1" || !delivery.Timestamp.Equal(sent) {
+				t.Fatalf("Unexpected delivery: %+v %v", delivery, err)
+			}
+		})
+	}
+}
+
+func TestTwilioValidator(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    string
+		body      string
+		signature string
+		proxies   []string
+		want      error
+	}{
+		{"valid", twilioURL, twilioBody, twilioSignature, nil, nil},
+		{"tampered param", twilioURL, strings.Replace(twilioBody, "1234", "4321", 1), twilioSignature, nil, ErrVerifyingTwilio},
+		{"different url", "https://mycompany.com/other.php?foo=1&bar=2", twilioBody, twilioSignature, nil, ErrVerifyingTwilio},
+		{"not base64", twilioURL, twilioBody, "%%%", nil, ErrVerifyingTwilio},
+		{"tls terminated by trusted proxy", "http://mycompany.com/myapp.php?foo=1&bar=2", twilioBody, twilioSignature,
+			[]string{"192.0.2.0/24"}, nil},
+		{"forwarded proto from untrusted peer", "http://mycompany.com/myapp.php?foo=1&bar=2", twilioBody, twilioSignature,
+			[]string{"10.0.0.0/8"}, ErrVerifyingTwilio},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, engine := gin.CreateTestContext(httptest.NewRecorder())
+			if tt.proxies != nil {
+				if err := engine.SetTrustedProxies(tt.proxies); err != nil {
+					t.Fatalf("Failed to set trusted proxies: %s", err)
+				}
+			}
+			c.Request = httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			c.Request.Header.Set(HeaderTwilio, tt.signature)
+			c.Request.Header.Set("X-Forwarded-Proto", "https")
+			if err := TwilioValidator(c, []byte(tt.body), twilioToken); !errors.Is(err, tt.want) {
+				t.Fatalf("Unexpected error: got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestShopifyValidator(t *testing.T) {
+	tests := []struct {
+		name      string
+		signature string
+		secret    string
+		want      error
+	}{
+		{"valid", shopifySignature, shopifySecret, nil},
+		{"wrong secret", shopifySignature, "shpss_other", ErrVerifyingShop},
+		{"missing", "", shopifySecret, ErrVerifyingShop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestContext(t, []byte(shopifyBody), map[string]string{HeaderShopify: tt.signature})
+			if err := ShopifyValidator(c, []byte(shopifyBody), tt.secret); !errors.Is(err, tt.want) {
+				t.Fatalf("Unexpected error: got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+// slack events, slash commands and interactive components
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+)
+
+// gin context keys holding the parsed slack payload
+const (
+	ContextKeySlackEvent       = "slack.event"
+	ContextKeySlackCommand     = "slack.command"
+	ContextKeySlackInteraction = "slack.interaction"
+)
+
+// SlackEventHandler handles an Events API callback
+type SlackEventHandler func(c *gin.Context, event slackevents.EventsAPIEvent)
+
+// SlackCommandHandler handles a slash command
+type SlackCommandHandler func(c *gin.Context, cmd slack.SlashCommand)
+
+// SlackInteractionHandler handles a block action or view submission
+type SlackInteractionHandler func(c *gin.Context, callback slack.InteractionCallback)
+
+// SlackRouter verifies, parses and dispatches slack requests to the handlers
+// registered for them. Requests without a handler continue down the chain with
+// the parsed payload stored on the gin context.
+type SlackRouter struct {
+	registry *SignatureRegistry
+	cfg      validationConfig
+
+	mu           sync.RWMutex
+	events       map[string]SlackEventHandler
+	commands     map[string]SlackCommandHandler
+	blockActions map[string]SlackInteractionHandler
+	views        map[string]SlackInteractionHandler
+}
+
+// NewSlackRouter creates a router verifying requests with signature, usually SlackSignature
+func NewSlackRouter(signature Signature, opts ...ValidationOption) *SlackRouter {
+	cfg := validationConfig{policy: PolicyEnforce}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return &SlackRouter{
+		registry:     &SignatureRegistry{signatures: []Signature{signature}},
+		cfg:          cfg,
+		events:       make(map[string]SlackEventHandler),
+		commands:     make(map[string]SlackCommandHandler),
+		blockActions: make(map[string]SlackInteractionHandler),
+		views:        make(map[string]SlackInteractionHandler),
+	}
+}
+
+// Event registers a handler for an inner event type such as app_mention
+func (r *SlackRouter) Event(eventType string, h SlackEventHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[eventType] = h
+}
+
+// Command registers a handler for a slash command such as /deploy
+func (r *SlackRouter) Command(command string, h SlackCommandHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands[command] = h
+}
+
+// BlockAction registers a handler for a block action by its action_id
+func (r *SlackRouter) BlockAction(actionID string, h SlackInteractionHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blockActions[actionID] = h
+}
+
+// ViewSubmission registers a handler for a view submission by the view callback_id
+func (r *SlackRouter) ViewSubmission(callbackID string, h SlackInteractionHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.views[callbackID] = h
+}
+
+// Handler is the middleware verifying and dispatching slack requests
+func (r *SlackRouter) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		data, err := RawBody(c)
+		if IsError(c, err) {
+			return
+		}
+		if !r.registry.validateRequest(c, data, r.cfg) {
+			return
+		}
+
+		var handled bool
+		if strings.HasPrefix(c.ContentType(), gin.MIMEPOSTForm) {
+			handled, err = r.dispatchForm(c, data)
+		} else {
+			handled, err = r.dispatchEvent(c, data)
+		}
+		if err != nil {
+			Abort(c, NewHTTPError(http.StatusBadRequest, err))
+			return
+		}
+		if handled {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// dispatchForm handles slash commands and interactive payloads
+func (r *SlackRouter) dispatchForm(c *gin.Context, data []byte) (bool, error) {
+	form, err := url.ParseQuery(string(data))
+	if err != nil {
+		return false, fmt.Errorf("failed to parse slack form: %w", err)
+	}
+
+	if payload := form.Get("payload"); payload != "" {
+		var callback slack.InteractionCallback
+		if err := json.Unmarshal([]byte(payload), &callback); err != nil {
+			return false, fmt.Errorf("failed to parse slack interaction: %w", err)
+		}
+		c.Set(ContextKeySlackInteraction, callback)
+
+		h := r.interactionHandler(callback)
+		if h == nil {
+			return false, nil
+		}
+		h(c, callback)
+
+		return true, nil
+	}
+
+	cmd, err := slack.SlashCommandParse(c.Request)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse slack command: %w", err)
+	}
+	c.Set(ContextKeySlackCommand, cmd)
+
+	r.mu.RLock()
+	h, ok := r.commands[cmd.Command]
+	r.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	h(c, cmd)
+
+	return true, nil
+}
+
+// interactionHandler finds the handler for a block action or view submission
+func (r *SlackRouter) interactionHandler(callback slack.InteractionCallback) SlackInteractionHandler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	switch callback.Type {
+	case slack.InteractionTypeBlockActions:
+		for _, action := range callback.ActionCallback.BlockActions {
+			if h, ok := r.blockActions[action.ActionID]; ok {
+				return h
+			}
+		}
+	case slack.InteractionTypeViewSubmission:
+		return r.views[callback.View.CallbackID]
+	}
+
+	return nil
+}
+
+// dispatchEvent handles Events API requests including the url verification challenge
+func (r *SlackRouter) dispatchEvent(c *gin.Context, data []byte) (bool, error) {
+	event, err := slackevents.ParseEvent(json.RawMessage(data), slackevents.OptionNoVerifyToken())
+	if err != nil {
+		return false, fmt.Errorf("failed to parse slack event: %w", err)
+	}
+	c.Set(ContextKeySlackEvent, event)
+
+	switch event.Type {
+	case slackevents.URLVerification:
+		if err := SlackChallengeValidator(c, data, ""); err != nil {
+			return false, err
+		}
+
+		return true, nil
+	case slackevents.CallbackEvent:
+		r.mu.RLock()
+		h, ok := r.events[event.InnerEvent.Type]
+		r.mu.RUnlock()
+		if !ok {
+			return false, nil
+		}
+		h(c, event)
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// SlackEventFrom returns the slack event parsed by SlackRouter
+func SlackEventFrom(c *gin.Context) (slackevents.EventsAPIEvent, bool) {
+	v, ok := c.Get(ContextKeySlackEvent)
+	if !ok {
+		return slackevents.EventsAPIEvent{}, false
+	}
+	event, ok := v.(slackevents.EventsAPIEvent)
+
+	return event, ok
+}
+
+// SlackCommandFrom returns the slash command parsed by SlackRouter
+func SlackCommandFrom(c *gin.Context) (slack.SlashCommand, bool) {
+	v, ok := c.Get(ContextKeySlackCommand)
+	if !ok {
+		return slack.SlashCommand{}, false
+	}
+	cmd, ok := v.(slack.SlashCommand)
+
+	return cmd, ok
+}
+
+// SlackInteractionFrom returns the interactive payload parsed by SlackRouter
+func SlackInteractionFrom(c *gin.Context) (slack.InteractionCallback, bool) {
+	v, ok := c.Get(ContextKeySlackInteraction)
+	if !ok {
+		return slack.InteractionCallback{}, false
+	}
+	callback, ok := v.(slack.InteractionCallback)
+
+	return callback, ok
+}
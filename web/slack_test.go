@@ -0,0 +1,105 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+
+	"github.com/threecommaio/opc/core/hmac"
+)
+
+const slackSecret = "slack-secret"
+
+// slackRequest builds a signed slack request
+func slackRequest(t *testing.T, contentType, body string) *http.Request {
+	t.Helper()
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	signature, err := hmac.Sign(hmac.Slack, []byte(body), []byte(slackSecret), "v0", ts)
+	if err != nil {
+		t.Fatalf("Failed to sign: %s", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/slack", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(HeaderSlackTimestamp, ts)
+	req.Header.Set(HeaderSlack, signature)
+
+	return req
+}
+
+func TestSlackRouter(t *testing.T) {
+	sr := NewSlackRouter(Signature{
+		Name: "slack", Header: HeaderSlack, Secret: StaticSecret(slackSecret), IsValid: SlackValidator,
+	})
+	sr.Command("/deploy", func(c *gin.Context, cmd slack.SlashCommand) {
+		c.String(http.StatusOK, "command "+cmd.Text)
+	})
+	sr.BlockAction("approve", func(c *gin.Context, callback slack.InteractionCallback) {
+		c.String(http.StatusOK, "action "+callback.User.ID)
+	})
+	sr.ViewSubmission("deploy_modal", func(c *gin.Context, callback slack.InteractionCallback) {
+		c.String(http.StatusOK, "view "+callback.View.CallbackID)
+	})
+	sr.Event("app_mention", func(c *gin.Context, event slackevents.EventsAPIEvent) {
+		c.String(http.StatusOK, "event "+event.InnerEvent.Type)
+	})
+
+	router := gin.New()
+	router.POST("/slack", sr.Handler(), func(c *gin.Context) {
+		cmd, ok := SlackCommandFrom(c)
+		if !ok {
+			c.String(http.StatusOK, "unhandled")
+			return
+		}
+		c.String(http.StatusOK, "fallthrough "+cmd.Command)
+	})
+
+	form := func(v url.Values) string { return v.Encode() }
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"slash command", gin.MIMEPOSTForm, form(url.Values{"command": {"/deploy"}, "text": {"api"}}), "command api"},
+		{"unhandled command", gin.MIMEPOSTForm, form(url.Values{"command": {"/rollback"}}), "fallthrough /rollback"},
+		{"block action", gin.MIMEPOSTForm, form(url.Values{"payload": {
+			`{"type":"block_actions","user":{"id":"U123"},"actions":[{"action_id":"approve","block_id":"b"}]}`,
+		}}), "action U123"},
+		{"view submission", gin.MIMEPOSTForm, form(url.Values{"payload": {
+			`{"type":"view_submission","view":{"callback_id":"deploy_modal"}}`,
+		}}), "view deploy_modal"},
+		{"event", gin.MIMEJSON, `{"type":"event_callback","event":{"type":"app_mention","text":"hi"}}`, "event app_mention"},
+		{"unhandled event", gin.MIMEJSON, `{"type":"event_callback","event":{"type":"reaction_added"}}`, "unhandled"},
+		{"url verification", gin.MIMEJSON, `{"type":"url_verification","challenge":"3eZbrw1aB"}`, "3eZbrw1aB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, slackRequest(t, tt.contentType, tt.body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Unexpected status: %d %s", w.Code, w.Body.String())
+			}
+			if w.Body.String() != tt.want {
+				t.Fatalf("Unexpected response: got %q, want %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+
+	t.Run("bad signature", func(t *testing.T) {
+		req := slackRequest(t, gin.MIMEPOSTForm, "command=%2Fdeploy")
+		req.Header.Set(HeaderSlack, "v0=00")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("Unexpected status: %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,210 @@
+// tls, mutual tls and http/2 configuration
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certCheckInterval is how often the certificate files are checked for changes
+var certCheckInterval = 10 * time.Second
+
+// errors
+var (
+	ErrTLSKeyPair  = errors.New("tls cert and key files must be set together")
+	ErrTLSVersion  = errors.New("unsupported tls version")
+	ErrTLSClientCA = errors.New("no certificates found in client ca file")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the server tls config, nil when tls is not configured
+func newTLSConfig(cfg SrvConfig) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		return nil, nil
+	}
+	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+		return nil, ErrTLSKeyPair
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if cfg.TLSMinVersion != "" {
+		v, ok := tlsVersions[cfg.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrTLSVersion, cfg.TLSMinVersion)
+		}
+		minVersion = v
+	}
+
+	reloader, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if cfg.TLSClientCAFile != "" {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = reloader.ClientCAs()
+		// net/http adds these to its own copy of the config, the copies made
+		// for each client below start from this one so they need them too
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := tlsConfig.Clone()
+			config.GetConfigForClient = nil
+			config.ClientCAs = reloader.ClientCAs()
+
+			return config, nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// certReloader serves a certificate and key pair and the client CA pool,
+// reloading them when any file changes on disk so certificates and CAs can
+// be rotated without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	interval time.Duration
+	now      func() time.Time
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   time.Time
+	checked   time.Time
+}
+
+// newCertReloader loads the certificate and key pair and the client CAs when
+// caFile is set
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		interval: certCheckInterval,
+		now:      time.Now,
+	}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.maybeReload()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// ClientCAs returns the current client CA pool, nil without a CA file
+func (r *certReloader) ClientCAs() *x509.CertPool {
+	r.maybeReload()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.clientCAs
+}
+
+// maybeReload reloads the files if they changed, the current ones are kept
+// when the new ones fail to load, for example while only one is written
+func (r *certReloader) maybeReload() {
+	now := r.now()
+	r.mu.Lock()
+	if now.Sub(r.checked) < r.interval {
+		r.mu.Unlock()
+		return
+	}
+	r.checked = now
+	current := r.modTime
+	r.mu.Unlock()
+
+	modTime, err := r.latestModTime()
+	if err != nil {
+		log.Warnf("failed to check tls certificate: %s", err)
+		return
+	}
+	if !modTime.After(current) {
+		return
+	}
+	if err := r.load(modTime); err != nil {
+		log.Warnf("failed to reload tls certificate: %s", err)
+		return
+	}
+	log.Infof("reloaded tls certificate %s", r.certFile)
+}
+
+// load reads the files and records the modification time they were loaded at
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client ca: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%w: %s", ErrTLSClientCA, r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTime = modTime
+
+	return nil
+}
+
+// latestModTime returns the most recent modification time of the files
+func (r *certReloader) latestModTime() (time.Time, error) {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat tls file: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
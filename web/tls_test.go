@@ -0,0 +1,347 @@
+package web
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+)
+
+// testCert is a certificate with its PEM encoded pair
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate for cn signed by parent, or self signed
+// as a CA when parent is nil
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("Failed to generate serial: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %s", err)
+	}
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeTestCert writes the pair to dir and returns the file names
+func writeTestCert(t *testing.T, dir string, c *testCert) (string, string) {
+	t.Helper()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := ioutil.WriteFile(certFile, c.certPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write cert: %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, c.keyPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write key: %s", err)
+	}
+
+	return certFile, keyFile
+}
+
+// startTestServer serves cfg on a random port until the test ends
+func startTestServer(t *testing.T, cfg SrvConfig) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	cfg.ReadTimeout, cfg.WriteTimeout = "10s", "10s"
+	s, router, err := New(cfg, WithListener(l))
+	if err != nil {
+		t.Fatalf("Server setup failed: %s", err)
+	}
+	router.GET("/proto", func(c *gin.Context) {
+		c.String(http.StatusOK, c.Request.Proto)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		if err := s.StartContext(ctx); err != nil {
+			t.Errorf("Server failed: %s", err)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func get(t *testing.T, client *http.Client, url string) (string, error) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+
+	return string(body), err
+}
+
+func TestTLSReload(t *testing.T) {
+	defer func(interval time.Duration) { certCheckInterval = interval }(certCheckInterval)
+	certCheckInterval = 0
+
+	ca := newTestCert(t, "ca", nil)
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, newTestCert(t, "first", ca))
+	addr := startTestServer(t, SrvConfig{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSMinVersion: "1.3"})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	servedCN := func() string {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12})
+		if err != nil {
+			t.Fatalf("Failed to dial: %s", err)
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		if state.Version != tls.VersionTLS13 {
+			t.Fatalf("Unexpected tls version: %x", state.Version)
+		}
+
+		return state.PeerCertificates[0].Subject.CommonName
+	}
+
+	if cn := servedCN(); cn != "first" {
+		t.Fatalf("Unexpected certificate: %s", cn)
+	}
+
+	// ensure the new files get a later modification time
+	later := time.Now().Add(time.Minute)
+	writeTestCert(t, dir, newTestCert(t, "second", ca))
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatalf("Failed to touch %s: %s", f, err)
+		}
+	}
+	if cn := servedCN(); cn != "second" {
+		t.Fatalf("Certificate was not reloaded: %s", cn)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12},
+		ForceAttemptHTTP2: true,
+	}}
+	proto, err := get(t, client, "https://"+addr+"/proto")
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	if proto != "HTTP/2.0" {
+		t.Fatalf("Expected HTTP/2 over tls, got %s", proto)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, newTestCert(t, "server", ca))
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, ca.certPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write ca: %s", err)
+	}
+	addr := startTestServer(t, SrvConfig{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: caFile})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientCert := newTestCert(t, "client", ca)
+	pair, err := tls.X509KeyPair(clientCert.certPEM, clientCert.keyPEM)
+	if err != nil {
+		t.Fatalf("Failed to load client pair: %s", err)
+	}
+
+	anonymous := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12},
+	}}
+	if _, err := get(t, anonymous, "https://"+addr+"/proto"); err == nil {
+		t.Fatal("Expected a client without a certificate to be rejected")
+	}
+
+	authenticated := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12},
+	}}
+	if _, err := get(t, authenticated, "https://"+addr+"/proto"); err != nil {
+		t.Fatalf("Client certificate was rejected: %s", err)
+	}
+}
+
+func TestMutualTLSReload(t *testing.T) {
+	defer func(interval time.Duration) { certCheckInterval = interval }(certCheckInterval)
+	certCheckInterval = 0
+
+	serverCA, oldCA, newCA := newTestCert(t, "server-ca", nil), newTestCert(t, "old-ca", nil), newTestCert(t, "new-ca", nil)
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, newTestCert(t, "server", serverCA))
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, oldCA.certPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write ca: %s", err)
+	}
+	addr := startTestServer(t, SrvConfig{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: caFile})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	clientFor := func(ca *testCert) *http.Client {
+		c := newTestCert(t, "client", ca)
+		pair, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+		if err != nil {
+			t.Fatalf("Failed to load client pair: %s", err)
+		}
+
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12},
+			ForceAttemptHTTP2: true,
+		}}
+	}
+	oldClient, newClient := clientFor(oldCA), clientFor(newCA)
+	if _, err := get(t, newClient, "https://"+addr+"/proto"); err == nil {
+		t.Fatal("Expected a certificate from the new CA to be rejected before rotating")
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := ioutil.WriteFile(caFile, newCA.certPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write ca: %s", err)
+	}
+	if err := os.Chtimes(caFile, later, later); err != nil {
+		t.Fatalf("Failed to touch ca: %s", err)
+	}
+	proto, err := get(t, newClient, "https://"+addr+"/proto")
+	if err != nil {
+		t.Fatalf("Client CA was not reloaded: %s", err)
+	}
+	if proto != "HTTP/2.0" {
+		t.Fatalf("Expected HTTP/2 over mutual tls, got %s", proto)
+	}
+	oldClient.Transport.(*http.Transport).CloseIdleConnections()
+	if _, err := get(t, oldClient, "https://"+addr+"/proto"); err == nil {
+		t.Fatal("Expected a certificate from the old CA to be rejected after rotating")
+	}
+}
+
+func TestCertReloaderClock(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, newTestCert(t, "first", ca))
+	r, err := newCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	now := time.Now()
+	r.interval = time.Minute
+	r.now = func() time.Time { return now }
+	servedCN := func() string {
+		cert, _ := r.GetCertificate(nil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("Failed to parse: %s", err)
+		}
+
+		return leaf.Subject.CommonName
+	}
+	servedCN()
+
+	later := time.Now().Add(time.Minute)
+	writeTestCert(t, dir, newTestCert(t, "second", ca))
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatalf("Failed to touch %s: %s", f, err)
+		}
+	}
+	if cn := servedCN(); cn != "first" {
+		t.Fatalf("Reloaded before the check interval: %s", cn)
+	}
+	now = now.Add(time.Minute)
+	if cn := servedCN(); cn != "second" {
+		t.Fatalf("Certificate was not reloaded: %s", cn)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	addr := startTestServer(t, SrvConfig{H2C: true})
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	proto, err := get(t, client, "http://"+addr+"/proto")
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	if proto != "HTTP/2.0" {
+		t.Fatalf("Expected h2c, got %s", proto)
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  SrvConfig
+		want error
+	}{
+		{"missing key", SrvConfig{TLSCertFile: "tls.crt"}, ErrTLSKeyPair},
+		{"bad version", SrvConfig{TLSCertFile: "tls.crt", TLSKeyFile: "tls.key", TLSMinVersion: "2.0"}, ErrTLSVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newTLSConfig(tt.cfg); !errors.Is(err, tt.want) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
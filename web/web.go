@@ -6,9 +6,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -22,16 +25,51 @@ import (
 	_ "github.com/gotailwindcss/tailwind"
 	_ "github.com/joncalhoun/form"
 	log "github.com/sirupsen/logrus"
+	"github.com/threecommaio/opc/core"
 	"github.com/threecommaio/opc/version"
-	ginlogrus "github.com/toorop/gin-logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	_ "google.golang.org/grpc"
 )
 
+const (
+	defaultShutdownTimeout = 5 * time.Second
+	// defaultDrainDelay gives load balancers time to see /readyz fail
+	defaultDrainDelay = 5 * time.Second
+)
+
 // Srv is the web server
 type Srv struct {
-	cfg    SrvConfig
-	quit   chan os.Signal
-	server *http.Server
+	cfg             SrvConfig
+	quit            chan os.Signal
+	server          *http.Server
+	router          *gin.Engine
+	admin           *http.Server
+	listener        net.Listener
+	health          *Health
+	bodyLimit       int64
+	securityHeaders *SecurityHeaders
+	err             error
+	shutdownTimeout time.Duration
+	drainDelay      time.Duration
+	state           *srvState
+}
+
+// srvState is shared by copies of Srv and the handlers registered in New
+type srvState struct {
+	ready int32
+
+	mu        sync.Mutex
+	hooks     []ShutdownHook
+	addr      net.Addr
+	adminAddr net.Addr
+}
+
+// ShutdownHook is run after the server stops accepting requests
+type ShutdownHook struct {
+	Name    string
+	Timeout time.Duration
+	Fn      func(ctx context.Context) error
 }
 
 // Option is used for configuring features of the webserver
@@ -42,6 +80,22 @@ type SrvConfig struct {
 	ListenAddress string
 	ReadTimeout   string
 	WriteTimeout  string
+	// ShutdownTimeout is how long in-flight requests may take, defaults to 5s
+	ShutdownTimeout string
+	// DrainDelay is how long to report not ready before shutting down so
+	// load balancers stop routing, defaults to 5s in production and none
+	// otherwise
+	DrainDelay string
+	// TLSCertFile and TLSKeyFile enable TLS, both are reloaded when changed on disk
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile requires clients to present a certificate signed by this
+	// CA, it is reloaded when changed on disk too
+	TLSClientCAFile string
+	// TLSMinVersion is the minimum TLS version such as 1.2 or 1.3, defaults to 1.2
+	TLSMinVersion string
+	// H2C serves HTTP/2 without TLS, for use behind a proxy terminating TLS
+	H2C bool
 }
 
 // New creates the webserver
@@ -49,11 +103,24 @@ func New(cfg SrvConfig, opts ...Option) (Srv, *gin.Engine, error) {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
-	// Setup the gin router
+	state := &srvState{}
+	health := NewHealth()
+
+	// Setup the gin router, routes only get the middleware installed before
+	// them so the hardening set up by the options is installed first
+	var hardening []gin.HandlerFunc
 	router := gin.New()
-	router.Use(ginlogrus.Logger(log.StandardLogger()), gin.Recovery())
+	router.Use(RequestID(), AccessLogger(), gin.Recovery(), func(c *gin.Context) {
+		for _, h := range hardening {
+			if h(c); c.IsAborted() {
+				return
+			}
+		}
+	})
 	// attach healthcheck
 	router.GET("/health", Healthz())
+	router.GET("/livez", health.Livez())
+	router.GET("/readyz", health.Readyz(state.isReady))
 
 	readTimeout, err := time.ParseDuration(cfg.ReadTimeout)
 	if err != nil {
@@ -63,18 +130,58 @@ func New(cfg SrvConfig, opts ...Option) (Srv, *gin.Engine, error) {
 	if err != nil {
 		return Srv{}, nil, fmt.Errorf("failed to parse write timeout: %w", err)
 	}
+	shutdownTimeout := defaultShutdownTimeout
+	if cfg.ShutdownTimeout != "" {
+		shutdownTimeout, err = time.ParseDuration(cfg.ShutdownTimeout)
+		if err != nil {
+			return Srv{}, nil, fmt.Errorf("failed to parse shutdown timeout: %w", err)
+		}
+	}
+	var drainDelay time.Duration
+	if core.Environment() == core.Production {
+		drainDelay = defaultDrainDelay
+	}
+	if cfg.DrainDelay != "" {
+		drainDelay, err = time.ParseDuration(cfg.DrainDelay)
+		if err != nil {
+			return Srv{}, nil, fmt.Errorf("failed to parse drain delay: %w", err)
+		}
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return Srv{}, nil, fmt.Errorf("failed to configure tls: %w", err)
+	}
+
+	var handler http.Handler = router
+	if cfg.H2C {
+		handler = h2c.NewHandler(router, &http2.Server{})
+	}
 
 	server := &http.Server{
 		Addr:           cfg.ListenAddress,
-		Handler:        router,
+		Handler:        handler,
 		ReadTimeout:    readTimeout,
 		WriteTimeout:   writeTimeout,
 		MaxHeaderBytes: 24 * humanize.KiByte,
+		TLSConfig:      tlsConfig,
 	}
 
 	srv := &Srv{
-		cfg:    cfg,
-		server: server,
+		cfg:             cfg,
+		server:          server,
+		router:          router,
+		shutdownTimeout: shutdownTimeout,
+		drainDelay:      drainDelay,
+		state:           state,
+		health:          health,
+	}
+
+	// safe defaults in production, options can override them
+	if core.Environment() == core.Production {
+		headers := DefaultSecurityHeaders()
+		srv.securityHeaders = &headers
+		srv.bodyLimit = DefaultBodyLimit
 	}
 
 	opts = append(opts, WithQuit(quit))
@@ -82,6 +189,10 @@ func New(cfg SrvConfig, opts ...Option) (Srv, *gin.Engine, error) {
 	for _, opt := range opts {
 		opt(srv)
 	}
+	if srv.err != nil {
+		return Srv{}, nil, fmt.Errorf("failed to configure server: %w", srv.err)
+	}
+	hardening = srv.hardening()
 
 	return *srv, router, nil
 }
@@ -93,37 +204,149 @@ func WithQuit(quit chan os.Signal) Option {
 	}
 }
 
-// Start starts the web server
+// WithListener serves on a pre-bound listener instead of ListenAddress, for
+// socket activation or tests listening on :0
+func WithListener(l net.Listener) Option {
+	return func(s *Srv) {
+		s.listener = l
+	}
+}
+
+// Addr returns the address the server is bound to, nil until started
+func (s *Srv) Addr() net.Addr {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	return s.state.addr
+}
+
+// Health returns the health subsystem serving /livez and /readyz, register
+// dependency checks on it
+func (s *Srv) Health() *Health {
+	return s.health
+}
+
+// AdminAddr returns the address the admin listener is bound to, nil until
+// started or without an admin listener
+func (s *Srv) AdminAddr() net.Addr {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	return s.state.adminAddr
+}
+
+// OnShutdown registers a hook run after the server has drained, hooks run in
+// the order they were registered each with its own timeout
+func (s *Srv) OnShutdown(name string, timeout time.Duration, fn func(ctx context.Context) error) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.hooks = append(s.state.hooks, ShutdownHook{Name: name, Timeout: timeout, Fn: fn})
+}
+
+// Start starts the web server and stops it on SIGINT or SIGTERM
 func (s *Srv) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-s.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return s.StartContext(ctx)
+}
+
+// StartContext starts the web server and stops it when ctx is cancelled,
+// errors binding or serving are returned immediately
+func (s *Srv) StartContext(ctx context.Context) error {
 	log.Infof("build release: %s", version.Release())
 
-	// Initializing the server in a goroutine so that
-	// it won't block the graceful shutdown handling below
+	l := s.listener
+	if l == nil {
+		var err error
+		l, err = net.Listen("tcp", s.server.Addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", s.server.Addr, err)
+		}
+	}
+	serveErr := make(chan error, 2)
+	if s.admin != nil {
+		al, err := net.Listen("tcp", s.admin.Addr)
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("failed to listen on admin %s: %w", s.admin.Addr, err)
+		}
+		s.state.mu.Lock()
+		s.state.adminAddr = al.Addr()
+		s.state.mu.Unlock()
+		go func() {
+			log.Infof("starting admin server on %s", al.Addr())
+			serveErr <- s.admin.Serve(al)
+		}()
+	}
+
+	s.state.mu.Lock()
+	s.state.addr = l.Addr()
+	s.state.mu.Unlock()
+
+	// Serving in a goroutine so that it won't block
+	// the graceful shutdown handling below
 	go func() {
-		log.Infof("starting web server on %s", s.cfg.ListenAddress)
-		if err := s.server.ListenAndServe(); err != nil && errors.Is(err, http.ErrServerClosed) {
-			log.Printf("listen: %s\n", err)
+		log.Infof("starting web server on %s", l.Addr())
+		if s.server.TLSConfig != nil {
+			// certificates come from TLSConfig.GetCertificate
+			serveErr <- s.server.ServeTLS(l, "", "")
+			return
 		}
+		serveErr <- s.server.Serve(l)
 	}()
+	s.state.setReady(true)
+
+	select {
+	case err := <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			s.state.setReady(false)
+			return nil
+		}
+		// stop whichever listener is still serving
+		if stopErr := s.abort(); stopErr != nil {
+			log.Error(stopErr)
+		}
 
-	<-s.quit
-	if err := s.Stop(); err != nil {
-		return err
+		return fmt.Errorf("failed to serve: %w", err)
+	case <-ctx.Done():
 	}
 
-	return nil
+	return s.Stop()
 }
 
-// Stop stops the web server
+// Stop reports not ready, drains in-flight requests and runs the shutdown hooks
 func (s *Srv) Stop() error {
 	log.Println("Shutting down server...")
+	s.state.setReady(false)
+	if s.drainDelay > 0 {
+		log.Infof("waiting %s for load balancers to stop routing", s.drainDelay)
+		time.Sleep(s.drainDelay)
+	}
 
-	// The context is used to inform the server it has 5 seconds to finish
-	// the request it is currently handling
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// The context is used to inform the server how long it has to finish
+	// the requests it is currently handling
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
 	defer cancel()
 
-	if err := s.server.Shutdown(ctx); err != nil {
+	err := s.server.Shutdown(ctx)
+	if s.admin != nil {
+		if adminErr := s.admin.Shutdown(ctx); err == nil {
+			err = adminErr
+		}
+	}
+	if hookErr := s.state.runHooks(); err == nil {
+		err = hookErr
+	}
+	if err != nil {
 		return fmt.Errorf("failed to gracefully shutdown server: %w", err)
 	}
 
@@ -132,12 +355,74 @@ func (s *Srv) Stop() error {
 	return nil
 }
 
-// IsError checks if err and aborts with json 500 error
+// abort stops the server after a listener failed, there is nothing left to
+// drain so connections are closed right away, the hooks still run to release
+// their resources
+func (s *Srv) abort() error {
+	s.state.setReady(false)
+	err := s.server.Close()
+	if s.admin != nil {
+		if adminErr := s.admin.Close(); err == nil {
+			err = adminErr
+		}
+	}
+	if hookErr := s.state.runHooks(); err == nil {
+		err = hookErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stop server: %w", err)
+	}
+
+	return nil
+}
+
+// Ready reports whether the server is accepting traffic
+func (s *Srv) Ready() bool {
+	return s.state.isReady()
+}
+
+func (st *srvState) setReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&st.ready, v)
+}
+
+func (st *srvState) isReady() bool {
+	return atomic.LoadInt32(&st.ready) == 1
+}
+
+// runHooks runs every hook in order and returns the first error
+func (st *srvState) runHooks() error {
+	st.mu.Lock()
+	hooks := append([]ShutdownHook(nil), st.hooks...)
+	st.mu.Unlock()
+
+	var first error
+	for _, hook := range hooks {
+		timeout := hook.Timeout
+		if timeout <= 0 {
+			timeout = defaultShutdownTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := hook.Fn(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("shutdown hook %s failed: %s", hook.Name, err)
+			if first == nil {
+				first = fmt.Errorf("shutdown hook %s: %w", hook.Name, err)
+			}
+		}
+	}
+
+	return first
+}
+
+// IsError checks if err and aborts with the status it maps to, see Abort
 func IsError(c *gin.Context, err error) bool {
 	if err != nil {
-		log.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError,
-			gin.H{"status": false, "message": err.Error()})
+		Abort(c, err)
 
 		return true // signal that there was an error and the caller should return
 	}
@@ -145,12 +430,14 @@ func IsError(c *gin.Context, err error) bool {
 	return false // no error, can continue
 }
 
-// IsError401 checks if err and aborts with json 401 error
+// IsError401 checks if err and aborts with a 401 unless err carries an HTTPError
 func IsError401(c *gin.Context, err error) bool {
 	if err != nil {
-		log.Warn(err)
-		c.AbortWithStatusJSON(http.StatusUnauthorized,
-			gin.H{"status": false, "message": err.Error()})
+		var httpErr *HTTPError
+		if !errors.As(err, &httpErr) {
+			err = NewHTTPError(http.StatusUnauthorized, err)
+		}
+		Abort(c, err)
 
 		return true // signal that there was an error and the caller should return
 	}
@@ -4,21 +4,27 @@ import (
 	"context"
 	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	log "github.com/sirupsen/logrus"
 )
 
 func TestWeb(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
 	srvCfg := SrvConfig{
-		ListenAddress: ":8080",
-		ReadTimeout:   "10s",
-		WriteTimeout:  "10s",
+		ReadTimeout:  "10s",
+		WriteTimeout: "10s",
 	}
 
-	s, router, err := New(srvCfg)
+	s, router, err := New(srvCfg, WithListener(l))
 	if err != nil {
 		t.Fatalf("Server setup failed: %s", err)
 	}
@@ -27,13 +33,15 @@ func TestWeb(t *testing.T) {
 		c.String(http.StatusOK, "pong")
 	})
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	go func() {
-		if err := s.server.ListenAndServe(); err != nil && errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("Server failed to start: %s", err)
+		if err := s.StartContext(ctx); err != nil {
+			t.Errorf("Server failed: %s", err)
 		}
 	}()
 
-	req, err := http.NewRequest("GET", "http://localhost:8080/ping", nil)
+	req, err := http.NewRequest("GET", "http://"+l.Addr().String()+"/ping", nil)
 	if err != nil {
 		t.Fatalf("Failed to create request: %s", err)
 	}
@@ -49,6 +57,134 @@ func TestWeb(t *testing.T) {
 	}
 
 	if string(body) != "pong" {
-		t.Fatalf("Unexpected server response: %s", err)
+		t.Fatalf("Unexpected server response: %s", body)
+	}
+	if s.Addr().String() != l.Addr().String() {
+		t.Fatalf("Unexpected bound address: %s", s.Addr())
+	}
+}
+
+func TestStartListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer l.Close()
+
+	s, _, err := New(SrvConfig{
+		ListenAddress: l.Addr().String(),
+		ReadTimeout:   "10s",
+		WriteTimeout:  "10s",
+	})
+	if err != nil {
+		t.Fatalf("Server setup failed: %s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Expected an error binding a port in use")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start blocked on a port in use")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, router, err := New(SrvConfig{
+		ListenAddress:   "127.0.0.1:0",
+		ReadTimeout:     "10s",
+		WriteTimeout:    "10s",
+		ShutdownTimeout: "1s",
+	})
+	if err != nil {
+		t.Fatalf("Server setup failed: %s", err)
+	}
+
+	var order []string
+	s.OnShutdown("readiness", time.Second, func(ctx context.Context) error {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected not ready while draining, got %d", w.Code)
+		}
+		order = append(order, "readiness")
+		return nil
+	})
+	s.OnShutdown("queue", time.Second, func(ctx context.Context) error {
+		order = append(order, "queue")
+		return errors.New("flush failed")
+	})
+	s.OnShutdown("db", 10*time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		order = append(order, "db")
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.StartContext(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.Ready() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !s.Ready() {
+		t.Fatal("Server never became ready")
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "shutdown hook queue") {
+			t.Fatalf("Expected hook error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not shut down")
+	}
+	if strings.Join(order, ",") != "readiness,queue,db" {
+		t.Fatalf("Unexpected hook order: %v", order)
+	}
+}
+
+// brokenListener fails Accept once the server is serving
+type brokenListener struct {
+	net.Listener
+}
+
+func (l brokenListener) Accept() (net.Conn, error) {
+	return nil, errors.New("listener broke")
+}
+
+func TestServeErrorSkipsDrain(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	s, _, err := New(SrvConfig{ReadTimeout: "10s", WriteTimeout: "10s", DrainDelay: "1h"},
+		WithListener(brokenListener{l}))
+	if err != nil {
+		t.Fatalf("Server setup failed: %s", err)
+	}
+	hookRan := false
+	s.OnShutdown("flush", time.Second, func(ctx context.Context) error {
+		hookRan = true
+		return nil
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- s.StartContext(context.Background()) }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "listener broke") {
+			t.Fatalf("Expected the serve error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server waited for the drain delay after its listener failed")
+	}
+	if !hookRan || s.Ready() {
+		t.Fatalf("Unexpected state after failure: hook ran %v, ready %v", hookRan, s.Ready())
 	}
 }
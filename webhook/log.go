@@ -0,0 +1,57 @@
+package webhook
+
+import (
+	"sync"
+)
+
+const defaultLogSize = 1000
+
+// DeliveryLog records delivery attempts for inspection
+type DeliveryLog interface {
+	Record(a Attempt) error
+	Attempts(messageID string) ([]Attempt, error)
+}
+
+// MemoryLog keeps the most recent delivery attempts in memory
+type MemoryLog struct {
+	mu       sync.Mutex
+	size     int
+	attempts []Attempt
+}
+
+// NewMemoryLog creates a log keeping at most size attempts
+func NewMemoryLog(size int) *MemoryLog {
+	if size <= 0 {
+		size = defaultLogSize
+	}
+
+	return &MemoryLog{size: size}
+}
+
+// Record adds an attempt, dropping the oldest when full
+func (l *MemoryLog) Record(a Attempt) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.attempts) >= l.size {
+		l.attempts = l.attempts[1:]
+	}
+	l.attempts = append(l.attempts, a)
+
+	return nil
+}
+
+// Attempts returns the attempts for a message oldest first
+func (l *MemoryLog) Attempts(messageID string) ([]Attempt, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var attempts []Attempt
+	for _, a := range l.attempts {
+		if a.MessageID == messageID {
+			attempts = append(attempts, a)
+		}
+	}
+
+	return attempts, nil
+}
@@ -0,0 +1,468 @@
+// Package webhook provides signed outbound webhook delivery
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/google/uuid"
+	"github.com/joncrlsn/dque"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/threecommaio/opc/core/hmac"
+)
+
+// headers sent with every delivery
+const (
+	HeaderSignature = "X-Signature"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+)
+
+const (
+	defaultQueueName       = "webhooks"
+	deadLetterSuffix       = "-dead"
+	defaultItemsPerSegment = 100
+	defaultTimeout         = 10 * time.Second
+	defaultMaxElapsedTime  = 15 * time.Minute
+)
+
+// errors
+var (
+	ErrNoSecret = errors.New("webhook secret is required")
+	ErrNoQueue  = errors.New("webhook queue directory is required")
+	ErrStatus   = errors.New("webhook delivery failed")
+)
+
+// Config is the configuration for the dispatcher
+type Config struct {
+	// QueueDir is where pending deliveries are persisted
+	QueueDir string
+	// QueueName defaults to webhooks, deliveries that are given up on are
+	// kept in QueueName-dead
+	QueueName string
+	// Secret signs every payload
+	Secret []byte
+	// Scheme defaults to hmac.Webhook, `sha256=<hex>` of "timestamp.body" in
+	// HeaderSignature, which web.WebhookSignature verifies on the receiving side
+	Scheme *hmac.Scheme
+	// Timeout is the timeout of a single attempt
+	Timeout time.Duration
+	// MaxElapsedTime is how long a delivery is retried before it is moved to
+	// the dead letter queue
+	MaxElapsedTime time.Duration
+	// MaxAttempts caps the number of attempts when set
+	MaxAttempts uint64
+}
+
+// Message is a webhook waiting to be delivered, it is persisted in the queue
+type Message struct {
+	ID        string
+	URL       string
+	Event     string
+	Payload   []byte
+	Headers   map[string]string
+	CreatedAt time.Time
+	// Attempts made so far and when the next one is due
+	Attempts    int
+	NextAttempt time.Time
+}
+
+// Attempt is a single delivery attempt of a message
+type Attempt struct {
+	MessageID  string
+	URL        string
+	Attempt    int
+	StatusCode int
+	Error      string
+	Duration   time.Duration
+	At         time.Time
+}
+
+// Dispatcher signs and delivers webhooks, pending deliveries are kept in a
+// disk queue so they survive restarts
+type Dispatcher struct {
+	cfg    Config
+	scheme hmac.Scheme
+	queue  *dque.DQue
+	dead   *dque.DQue
+	client *http.Client
+	log    DeliveryLog
+	// notify wakes the delivery loop while it waits for a retry
+	notify chan struct{}
+
+	start  sync.Once
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Option is used for configuring the dispatcher
+type Option func(*Dispatcher)
+
+// WithClient sets the http client used for deliveries
+func WithClient(client *http.Client) Option {
+	return func(d *Dispatcher) {
+		d.client = client
+	}
+}
+
+// WithDeliveryLog sets where delivery attempts are recorded
+func WithDeliveryLog(l DeliveryLog) Option {
+	return func(d *Dispatcher) {
+		d.log = l
+	}
+}
+
+// New creates the dispatcher and opens its queue
+func New(cfg Config, opts ...Option) (*Dispatcher, error) {
+	if len(cfg.Secret) == 0 {
+		return nil, ErrNoSecret
+	}
+	if cfg.QueueDir == "" {
+		return nil, ErrNoQueue
+	}
+	if cfg.QueueName == "" {
+		cfg.QueueName = defaultQueueName
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.MaxElapsedTime == 0 {
+		cfg.MaxElapsedTime = defaultMaxElapsedTime
+	}
+	scheme := hmac.Webhook
+	if cfg.Scheme != nil {
+		scheme = *cfg.Scheme
+	}
+	if _, err := hmac.Sign(scheme, nil, cfg.Secret); err != nil {
+		return nil, fmt.Errorf("invalid webhook scheme: %w", err)
+	}
+
+	newMessage := func() interface{} {
+		return &Message{}
+	}
+	queue, err := dque.NewOrOpen(cfg.QueueName, cfg.QueueDir, defaultItemsPerSegment, newMessage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open webhook queue: %w", err)
+	}
+	dead, err := dque.NewOrOpen(cfg.QueueName+deadLetterSuffix, cfg.QueueDir, defaultItemsPerSegment, newMessage)
+	if err != nil {
+		queue.Close()
+		return nil, fmt.Errorf("failed to open webhook dead letter queue: %w", err)
+	}
+
+	d := &Dispatcher{
+		cfg:    cfg,
+		scheme: scheme,
+		queue:  queue,
+		dead:   dead,
+		client: &http.Client{Timeout: cfg.Timeout},
+		log:    NewMemoryLog(0),
+		notify: make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	return d, nil
+}
+
+// Send queues the payload for delivery to url and returns the message id
+func (d *Dispatcher) Send(url, event string, payload []byte, headers map[string]string) (string, error) {
+	msg := &Message{
+		ID:        uuid.NewString(),
+		URL:       url,
+		Event:     event,
+		Payload:   payload,
+		Headers:   headers,
+		CreatedAt: time.Now(),
+	}
+	if err := d.queue.Enqueue(msg); err != nil {
+		return "", fmt.Errorf("failed to queue webhook: %w", err)
+	}
+	d.wake()
+
+	return msg.ID, nil
+}
+
+// Pending returns the number of queued deliveries
+func (d *Dispatcher) Pending() int {
+	return d.queue.Size()
+}
+
+// DeadLetters returns the number of deliveries that were given up on
+func (d *Dispatcher) DeadLetters() int {
+	return d.dead.Size()
+}
+
+// Redrive moves the dead letters back to the queue with fresh retries and
+// returns how many were moved
+func (d *Dispatcher) Redrive() (int, error) {
+	moved := 0
+	for {
+		obj, err := d.dead.Peek()
+		if errors.Is(err, dque.ErrEmpty) {
+			break
+		}
+		if err != nil {
+			return moved, fmt.Errorf("failed to read webhook dead letter queue: %w", err)
+		}
+		msg := obj.(*Message)
+		msg.Attempts = 0
+		msg.NextAttempt = time.Time{}
+		msg.CreatedAt = time.Now()
+		if err := d.queue.Enqueue(msg); err != nil {
+			return moved, fmt.Errorf("failed to queue webhook: %w", err)
+		}
+		if _, err := d.dead.Dequeue(); err != nil {
+			return moved, fmt.Errorf("failed to remove webhook from dead letter queue: %w", err)
+		}
+		moved++
+	}
+	if moved > 0 {
+		d.wake()
+	}
+
+	return moved, nil
+}
+
+// Attempts returns the recorded attempts for a message
+func (d *Dispatcher) Attempts(messageID string) ([]Attempt, error) {
+	return d.log.Attempts(messageID)
+}
+
+// Start delivers queued messages in the background until Close is called.
+// Each message gets one attempt at a time, a failed one goes to the back of
+// the queue until its retry is due so a slow receiver doesn't hold up the
+// others. Messages are only removed once they succeed or are moved to the
+// dead letter queue, so an interrupted delivery is retried after a restart.
+// Calling it again has no effect.
+func (d *Dispatcher) Start(ctx context.Context) {
+	d.start.Do(func() {
+		ctx, d.cancel = context.WithCancel(ctx)
+		d.wg.Add(1)
+		go d.run(ctx)
+	})
+}
+
+// run delivers queued messages until the queue is closed or ctx is done
+func (d *Dispatcher) run(ctx context.Context) {
+	defer d.wg.Done()
+	// waiting counts the messages in a row that aren't due, once every
+	// queued message was seen the loop sleeps until the earliest is due
+	var waiting int
+	var next time.Time
+	for {
+		obj, err := d.queue.PeekBlock()
+		if err != nil {
+			if !errors.Is(err, dque.ErrQueueClosed) {
+				log.Errorf("failed to read webhook queue: %s", err)
+			}
+			return
+		}
+		msg := obj.(*Message)
+		if time.Now().Before(msg.NextAttempt) {
+			if next.IsZero() || msg.NextAttempt.Before(next) {
+				next = msg.NextAttempt
+			}
+			if waiting++; waiting >= d.queue.Size() {
+				if !d.sleep(ctx, time.Until(next)) {
+					return
+				}
+				waiting, next = 0, time.Time{}
+				continue
+			}
+			if err := d.requeue(msg); err != nil {
+				log.WithField("delivery", msg.ID).Errorf("failed to requeue webhook: %s", err)
+				return
+			}
+			continue
+		}
+		waiting, next = 0, time.Time{}
+		if !d.attempt(ctx, msg) {
+			return
+		}
+	}
+}
+
+// attempt makes one delivery attempt of the message at the head of the queue
+// and removes, requeues or dead letters it, false means ctx is done
+func (d *Dispatcher) attempt(ctx context.Context, msg *Message) bool {
+	start := time.Now()
+	status, err := d.post(ctx, msg)
+	if ctx.Err() != nil {
+		// interrupted, the message stays at the head of the queue
+		return false
+	}
+	msg.Attempts++
+	a := Attempt{
+		MessageID:  msg.ID,
+		URL:        msg.URL,
+		Attempt:    msg.Attempts,
+		StatusCode: status,
+		Duration:   time.Since(start),
+		At:         start,
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	if logErr := d.log.Record(a); logErr != nil {
+		log.Warnf("failed to record webhook attempt: %s", logErr)
+	}
+
+	entry := log.WithField("delivery", msg.ID)
+	switch {
+	case err == nil:
+		if _, err := d.queue.Dequeue(); err != nil && !errors.Is(err, dque.ErrQueueClosed) {
+			entry.Errorf("failed to remove webhook from queue: %s", err)
+		}
+	case !retryable(status) || d.exhausted(msg):
+		entry.Errorf("giving up on webhook: %s", err)
+		if err := d.dead.Enqueue(msg); err != nil {
+			entry.Errorf("failed to dead letter webhook: %s", err)
+			return true
+		}
+		if _, err := d.queue.Dequeue(); err != nil && !errors.Is(err, dque.ErrQueueClosed) {
+			entry.Errorf("failed to remove webhook from queue: %s", err)
+		}
+	default:
+		msg.NextAttempt = time.Now().Add(retryDelay(msg.Attempts))
+		if err := d.requeue(msg); err != nil && !errors.Is(err, dque.ErrQueueClosed) {
+			entry.Errorf("failed to requeue webhook: %s", err)
+		}
+	}
+
+	return true
+}
+
+// exhausted reports whether the message is out of retries
+func (d *Dispatcher) exhausted(msg *Message) bool {
+	if d.cfg.MaxAttempts > 0 && uint64(msg.Attempts) >= d.cfg.MaxAttempts {
+		return true
+	}
+
+	return time.Since(msg.CreatedAt) >= d.cfg.MaxElapsedTime
+}
+
+// requeue moves the message at the head of the queue to the back, it is
+// added before it is removed so a crash in between delivers it twice rather
+// than never
+func (d *Dispatcher) requeue(msg *Message) error {
+	if err := d.queue.Enqueue(msg); err != nil {
+		return err
+	}
+	_, err := d.queue.Dequeue()
+
+	return err
+}
+
+// sleep waits for wait, a new message or ctx, false means ctx is done
+func (d *Dispatcher) sleep(ctx context.Context, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-d.notify:
+	case <-ctx.Done():
+		return false
+	}
+
+	return true
+}
+
+// wake interrupts a sleeping delivery loop
+func (d *Dispatcher) wake() {
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops delivering and closes the queues, an in-flight delivery stays
+// queued
+func (d *Dispatcher) Close() error {
+	if d.cancel != nil {
+		d.cancel()
+	}
+	err := d.queue.Close()
+	d.wg.Wait()
+	if deadErr := d.dead.Close(); err == nil {
+		err = deadErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to close webhook queue: %w", err)
+	}
+
+	return nil
+}
+
+// retryDelay is the exponential backoff with jitter before the attempt after
+// the given number of attempts
+func retryDelay(attempts int) time.Duration {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0
+	delay := b.NextBackOff()
+	for i := 1; i < attempts; i++ {
+		delay = b.NextBackOff()
+	}
+
+	return delay
+}
+
+// post makes a single signed delivery attempt, the timestamp is signed with
+// the body so a captured request can't be replayed later
+func (d *Dispatcher) post(ctx context.Context, msg *Message) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature, err := hmac.Sign(d.scheme, msg.Payload, d.cfg.Secret, timestamp)
+	if err != nil {
+		return 0, fmt.Errorf("failed to sign webhook: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, msg.URL, bytes.NewReader(msg.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	for k, v := range msg.Headers {
+		req.Header.Set(k, v)
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(HeaderSignature, signature)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderDelivery, msg.ID)
+	req.Header.Set(HeaderEvent, msg.Event)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to deliver webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("%w: %s", ErrStatus, resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// retryable reports whether a failed attempt with status should be retried,
+// client errors other than timeouts and rate limits will not succeed later
+func retryable(status int) bool {
+	if status == 0 || status >= 500 {
+		return true
+	}
+
+	return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
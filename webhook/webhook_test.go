@@ -0,0 +1,211 @@
+package webhook
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/threecommaio/opc/core/hmac"
+)
+
+func TestDispatcherRetries(t *testing.T) {
+	secret := []byte("outbound-secret")
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp := r.Header.Get(HeaderTimestamp)
+		if err := hmac.Webhook.Validate(r.Header.Get(HeaderSignature), body, secret, timestamp); err != nil {
+			t.Errorf("Invalid signature: %s", err)
+		}
+		if r.Header.Get(HeaderEvent) != "deploy.finished" {
+			t.Errorf("Unexpected event: %s", r.Header.Get(HeaderEvent))
+		}
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	d, err := New(Config{QueueDir: t.TempDir(), Secret: secret, MaxAttempts: 3})
+	if err != nil {
+		t.Fatalf("Failed to create dispatcher: %s", err)
+	}
+	id, err := d.Send(srv.URL, "deploy.finished", []byte(`{"ok":true}`), nil)
+	if err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	d.Start(context.Background())
+	// a second call must not start another delivery loop
+	d.Start(context.Background())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Failed to close: %s", err)
+	}
+
+	attempts, err := d.Attempts(id)
+	if err != nil {
+		t.Fatalf("Failed to read attempts: %s", err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("Unexpected attempts: %+v", attempts)
+	}
+	if attempts[0].StatusCode != http.StatusBadGateway || attempts[1].StatusCode != http.StatusNoContent {
+		t.Fatalf("Unexpected status codes: %d, %d", attempts[0].StatusCode, attempts[1].StatusCode)
+	}
+}
+
+func TestDispatcherPermanentFailure(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer srv.Close()
+
+	d, err := New(Config{QueueDir: t.TempDir(), Secret: []byte("s")})
+	if err != nil {
+		t.Fatalf("Failed to create dispatcher: %s", err)
+	}
+	if _, err := d.Send(srv.URL, "ping", []byte(`{}`), nil); err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	d.Start(context.Background())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d.DeadLetters() != 1 {
+		t.Fatalf("Expected the delivery in the dead letter queue, got %d", d.DeadLetters())
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Failed to close: %s", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("Client errors should not be retried, got %d attempts", n)
+	}
+}
+
+func TestDispatcherFailingReceiverDoesNotBlock(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	delivered := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+		close(delivered)
+	}))
+	defer up.Close()
+
+	d, err := New(Config{QueueDir: t.TempDir(), Secret: []byte("s")})
+	if err != nil {
+		t.Fatalf("Failed to create dispatcher: %s", err)
+	}
+	defer d.Close()
+	failing, err := d.Send(down.URL, "ping", []byte(`{}`), nil)
+	if err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	if _, err := d.Send(up.URL, "ping", []byte(`{}`), nil); err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	d.Start(context.Background())
+
+	select {
+	case <-delivered:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Delivery was held up by the failing receiver")
+	}
+	// the failing delivery is still queued for a retry
+	deadline := time.Now().Add(time.Second)
+	for d.Pending() > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if attempts, _ := d.Attempts(failing); len(attempts) == 0 || d.Pending() != 1 {
+		t.Fatalf("Unexpected state: %d attempts, %d pending", len(attempts), d.Pending())
+	}
+}
+
+func TestDispatcherDeadLetters(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	d, err := New(Config{QueueDir: dir, Secret: []byte("s"), MaxAttempts: 2})
+	if err != nil {
+		t.Fatalf("Failed to create dispatcher: %s", err)
+	}
+	if _, err := d.Send(srv.URL, "ping", []byte(`{}`), nil); err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	d.Start(context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for d.DeadLetters() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Failed to close: %s", err)
+	}
+
+	// dead letters survive a restart and can be redriven
+	d, err = New(Config{QueueDir: dir, Secret: []byte("s"), MaxAttempts: 2})
+	if err != nil {
+		t.Fatalf("Failed to reopen dispatcher: %s", err)
+	}
+	defer d.Close()
+	if d.DeadLetters() != 1 || d.Pending() != 0 {
+		t.Fatalf("Unexpected queues: %d dead, %d pending", d.DeadLetters(), d.Pending())
+	}
+	if n, err := d.Redrive(); err != nil || n != 1 {
+		t.Fatalf("Failed to redrive: %d %v", n, err)
+	}
+	d.Start(context.Background())
+	deadline = time.Now().Add(5 * time.Second)
+	for d.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d.Pending() != 0 || d.DeadLetters() != 0 || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("Redriven delivery failed: %d pending, %d calls", d.Pending(), atomic.LoadInt32(&calls))
+	}
+}
+
+func TestDispatcherSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	d, err := New(Config{QueueDir: dir, Secret: []byte("s")})
+	if err != nil {
+		t.Fatalf("Failed to create dispatcher: %s", err)
+	}
+	if _, err := d.Send("http://127.0.0.1:0", "ping", []byte(`{}`), nil); err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Failed to close: %s", err)
+	}
+
+	d, err = New(Config{QueueDir: dir, Secret: []byte("s")})
+	if err != nil {
+		t.Fatalf("Failed to reopen dispatcher: %s", err)
+	}
+	defer d.Close()
+	if d.Pending() != 1 {
+		t.Fatalf("Pending delivery was lost: %d", d.Pending())
+	}
+}